@@ -0,0 +1,272 @@
+// Package apperror holds typed domain errors that map to grpc statuses
+// Service code returns them instead of building statuses by hand:
+//     return nil, apperror.NotFound("ACCOUNT_NOT_FOUND", "account %s not found", id).
+//         WithMetadata("account_id", id)
+// The status carries an ErrorInfo detail, plus RetryInfo and BadRequest
+// details when set. Clients turn statuses back into typed errors by
+// FromError.
+package apperror
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FieldViolation is a violation of a request field
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+// Error is a domain error
+type Error struct {
+	// Code is the grpc code of the error
+	Code codes.Code
+	// Reason identifies the error within Domain, in UPPER_SNAKE_CASE
+	Reason string
+	// Domain is the service that defines Reason, e.g. account.example.com
+	Domain string
+	// Message is shown to callers
+	Message string
+	// Metadata gives the context of the error, e.g. the ID of a resource
+	Metadata map[string]string
+	// RetryDelay tells callers how long to wait before a retry, zero when
+	// unknown
+	RetryDelay time.Duration
+	// Violations are the invalid fields of an InvalidArgument error
+	Violations []FieldViolation
+
+	cause error
+}
+
+// New returns an Error of code
+func New(code codes.Code, reason, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// InvalidArgument returns an error of a request that is invalid whatever the
+// state of the system
+func InvalidArgument(reason, format string, args ...interface{}) *Error {
+	return New(codes.InvalidArgument, reason, format, args...)
+}
+
+// NotFound returns an error of a missing resource
+func NotFound(reason, format string, args ...interface{}) *Error {
+	return New(codes.NotFound, reason, format, args...)
+}
+
+// AlreadyExists returns an error of a resource that cannot be created twice
+func AlreadyExists(reason, format string, args ...interface{}) *Error {
+	return New(codes.AlreadyExists, reason, format, args...)
+}
+
+// Conflict returns an error of a concurrent modification, the caller may
+// retry the whole read-modify-write sequence
+func Conflict(reason, format string, args ...interface{}) *Error {
+	return New(codes.Aborted, reason, format, args...)
+}
+
+// FailedPrecondition returns an error of a request the system is not in a
+// state to handle, e.g. deleting a non empty folder
+func FailedPrecondition(reason, format string, args ...interface{}) *Error {
+	return New(codes.FailedPrecondition, reason, format, args...)
+}
+
+// Unauthenticated returns an error of a caller without valid credentials
+func Unauthenticated(reason, format string, args ...interface{}) *Error {
+	return New(codes.Unauthenticated, reason, format, args...)
+}
+
+// PermissionDenied returns an error of a caller that is not allowed
+func PermissionDenied(reason, format string, args ...interface{}) *Error {
+	return New(codes.PermissionDenied, reason, format, args...)
+}
+
+// ResourceExhausted returns an error of a quota or rate limit, the caller
+// may retry after retryDelay
+func ResourceExhausted(reason string, retryDelay time.Duration, format string, args ...interface{}) *Error {
+	e := New(codes.ResourceExhausted, reason, format, args...)
+	e.RetryDelay = retryDelay
+
+	return e
+}
+
+// Unavailable returns an error of a transient failure, the caller may retry
+// after retryDelay
+func Unavailable(reason string, retryDelay time.Duration, format string, args ...interface{}) *Error {
+	e := New(codes.Unavailable, reason, format, args...)
+	e.RetryDelay = retryDelay
+
+	return e
+}
+
+// Internal returns an error of a broken invariant
+// The cause is logged but not sent to callers.
+func Internal(cause error, reason, format string, args ...interface{}) *Error {
+	e := New(codes.Internal, reason, format, args...)
+	e.cause = cause
+
+	return e
+}
+
+// WithMetadata sets the metadata key of e to value
+func (e *Error) WithMetadata(key, value string) *Error {
+	if e.Metadata == nil {
+		e.Metadata = make(map[string]string)
+	}
+	e.Metadata[key] = value
+
+	return e
+}
+
+// WithViolation adds a violation of field to e
+func (e *Error) WithViolation(field, description string) *Error {
+	e.Violations = append(e.Violations, FieldViolation{Field: field, Description: description})
+
+	return e
+}
+
+// WithCause sets the error that caused e
+func (e *Error) WithCause(cause error) *Error {
+	e.cause = cause
+
+	return e
+}
+
+// Cause returns the error that caused e, nil when none
+func (e *Error) Cause() error {
+	return e.cause
+}
+
+// Error implements error
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Code, e.Message)
+	if e.Reason != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Reason)
+	}
+	if e.cause != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.cause)
+	}
+
+	return msg
+}
+
+// GRPCStatus returns the status of e, so that grpc sends e as a status when
+// a handler returns it
+func (e *Error) GRPCStatus() *status.Status {
+	st := status.New(e.Code, e.Message)
+
+	var details []proto.Message
+	if e.Reason != "" {
+		details = append(details, &errdetails.ErrorInfo{Reason: e.Reason, Domain: e.Domain, Metadata: e.Metadata})
+	}
+	if e.RetryDelay > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(e.RetryDelay)})
+	}
+	if len(e.Violations) > 0 {
+		br := &errdetails.BadRequest{}
+		for _, v := range e.Violations {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: v.Field, Description: v.Description})
+		}
+		details = append(details, br)
+	}
+
+	if ds, err := st.WithDetails(details...); err == nil {
+		st = ds
+	}
+
+	return st
+}
+
+// As returns the Error of err or of its causes
+func As(err error) (*Error, bool) {
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e, true
+		}
+
+		c, ok := err.(interface{ Cause() error })
+		if ok == false {
+			return nil, false
+		}
+		err = c.Cause()
+	}
+
+	return nil, false
+}
+
+// FromError returns the Error of err
+// err is an Error, an error caused by one, or a grpc status error whose
+// details are decoded. It returns nil when err is nil, and an Error of
+// codes.Unknown when err is not a status error.
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := As(err); ok {
+		return e
+	}
+
+	st, ok := status.FromError(err)
+	if ok == false {
+		return &Error{Code: codes.Unknown, Message: err.Error(), cause: err}
+	}
+
+	e := &Error{
+		Code:    st.Code(),
+		Message: st.Message(),
+	}
+
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.ErrorInfo:
+			e.Reason = d.Reason
+			e.Domain = d.Domain
+			e.Metadata = d.Metadata
+		case *errdetails.RetryInfo:
+			if delay, err := ptypes.Duration(d.RetryDelay); err == nil {
+				e.RetryDelay = delay
+			}
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				e.Violations = append(e.Violations, FieldViolation{Field: v.Field, Description: v.Description})
+			}
+		}
+	}
+
+	return e
+}
+
+// Code returns the grpc code of err, codes.OK when err is nil
+func Code(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+
+	return FromError(err).Code
+}
+
+// Retryable returns true when a call that failed with err may succeed when
+// retried as is
+// Aborted is not retryable: the whole read-modify-write sequence must be
+// retried, not the last call. DeadlineExceeded is not either, since the call
+// may have been applied.
+func Retryable(err error) bool {
+	switch Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+
+	return false
+}
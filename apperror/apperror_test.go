@@ -0,0 +1,57 @@
+package apperror
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFromError(t *testing.T) {
+	e := Unavailable("DB_UNAVAILABLE", 2*time.Second, "database %s is unavailable", "accounts").
+		WithMetadata("db", "accounts").
+		WithViolation("id", "must not be empty")
+	e.Domain = "account.example.com"
+
+	// as a client receives it
+	err := e.GRPCStatus().Err()
+
+	got := FromError(err)
+	if got.Code != codes.Unavailable || got.Message != "database accounts is unavailable" {
+		t.Fatalf("FromError = %v", got)
+	}
+	if got.Reason != "DB_UNAVAILABLE" || got.Domain != "account.example.com" || got.Metadata["db"] != "accounts" {
+		t.Fatalf("ErrorInfo = %q %q %v", got.Reason, got.Domain, got.Metadata)
+	}
+	if got.RetryDelay != 2*time.Second {
+		t.Fatalf("RetryDelay = %v, want 2s", got.RetryDelay)
+	}
+	if len(got.Violations) != 1 || got.Violations[0].Field != "id" {
+		t.Fatalf("Violations = %v", got.Violations)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{NotFound("ACCOUNT_NOT_FOUND", "not found"), false},
+		{Conflict("VERSION_MISMATCH", "conflict"), false},
+		{status.Error(codes.DeadlineExceeded, "deadline"), false},
+		{ResourceExhausted("RATE_LIMITED", time.Second, "slow down"), true},
+		{Internal(errors.New("nil pointer"), "", "internal error"), false},
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{status.Error(codes.InvalidArgument, "bad"), false},
+		{errors.New("plain"), false},
+	}
+
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.retryable {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.retryable)
+		}
+	}
+}
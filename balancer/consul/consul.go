@@ -18,8 +18,8 @@ type Balancer struct {
 }
 
 // NewBalancer initializes and returns a new Balancer.
-func NewBalancer(consul coordinator.Coordinator, service, tag string, log *logger.Logger) (balancer.Balancer, error) {
-	resolver, err := newResolver(consul, service, tag, log)
+func NewBalancer(consul coordinator.Coordinator, service, tag string, log *logger.Logger, opts ...ResolverOption) (balancer.Balancer, error) {
+	resolver, err := newResolver(consul, service, tag, log, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -36,8 +36,8 @@ func (b *Balancer) GetResolver(ctx context.Context) naming.Resolver {
 }
 
 // GetResolver returns a Resolver
-func GetResolver(consul coordinator.Coordinator, service, tag string, log *logger.Logger) (naming.Resolver, error) {
-	resolver, err := newResolver(consul, service, tag, log)
+func GetResolver(consul coordinator.Coordinator, service, tag string, log *logger.Logger, opts ...ResolverOption) (naming.Resolver, error) {
+	resolver, err := newResolver(consul, service, tag, log, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -1,9 +1,15 @@
 package consul
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/naming"
 
 	coordinator "github.com/servicekit/servicekit-go/coordinator/consul"
 	"github.com/servicekit/servicekit-go/logger"
@@ -20,3 +26,270 @@ func TestNewConsulBalancer(t *testing.T) {
 
 	NewBalancer(tc, "", "", &logger.Logger{})
 }
+
+func TestResolverFallback(t *testing.T) {
+	tc := &coordinator.TestConsul{
+		GetServicesError: errors.New("connection refused"),
+	}
+
+	r, err := newResolver(tc, "account", "", &logger.Logger{}, WithFallback("10.0.0.1:8080"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	updates, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 1 || updates[0].Op != naming.Add || updates[0].Addr != "10.0.0.1:8080" {
+		t.Errorf("unexpected updates: %v", updates)
+	}
+
+	if r.Err() == nil {
+		t.Error("registry error should be reported")
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	tc := &coordinator.TestConsul{
+		GetServicesServices: []*spec.Service{{ID: "account-1", Address: "10.0.0.1", Port: 8080}},
+		GetServicesMeta:     &api.QueryMeta{LastIndex: 1},
+	}
+
+	r, err := newResolver(tc, "account", "", &logger.Logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Addr != "10.0.0.1:8080" {
+		t.Errorf("unexpected updates: %v", updates)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Next()
+		errc <- err
+	}()
+
+	r.Close()
+	r.Close()
+
+	select {
+	case <-r.done:
+	default:
+		t.Error("watch loop should exit on Close")
+	}
+
+	if err := <-errc; err == nil {
+		t.Error("Next should fail after Close")
+	}
+}
+
+func TestResolverSnapshots(t *testing.T) {
+	tc := &coordinator.TestConsul{
+		GetServicesServices: []*spec.Service{{ID: "account-1", Address: "10.0.0.1", Port: 8080, Tags: []string{"v2"}}},
+		GetServicesMeta:     &api.QueryMeta{LastIndex: 42},
+	}
+
+	r, err := newResolver(tc, "snapshot", "v2", &logger.Logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	find := func() *ResolverSnapshot {
+		for _, s := range Snapshots() {
+			if s.Service == "snapshot" {
+				return &s
+			}
+		}
+		return nil
+	}
+
+	s := find()
+	if s == nil {
+		t.Fatal("live resolver should be listed")
+	}
+	if s.Tag != "v2" || s.LastIndex != 42 || len(s.Addresses) != 1 || s.Addresses[0].Addr != "10.0.0.1:8080" {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+
+	r.Close()
+
+	if find() != nil {
+		t.Error("closed resolver should not be listed")
+	}
+}
+
+func TestMakeUpdatesRetag(t *testing.T) {
+	r := &Resolver{}
+
+	old := map[string]*spec.Service{"10.0.0.1:8080": {ID: "account-1", Tags: []string{"v1"}}}
+	retagged := &spec.Service{ID: "account-1", Tags: []string{"v1", "canary"}}
+
+	updates := r.makeUpdates(old, map[string]*spec.Service{"10.0.0.1:8080": retagged})
+	if len(updates) != 1 || updates[0].Op != naming.Add || updates[0].Metadata != retagged {
+		t.Errorf("a retag should be a single Add, got %v", updates)
+	}
+}
+
+func TestResolverSubsetSameID(t *testing.T) {
+	r := &Resolver{subsetClientID: "client-1", subsetSize: 2}
+
+	// service IDs are only unique per agent
+	instances := map[string]*spec.Service{
+		"10.0.0.1:8080": {ID: "account", Address: "10.0.0.1", Port: 8080},
+		"10.0.0.2:8080": {ID: "account", Address: "10.0.0.2", Port: 8080},
+		"10.0.0.3:8080": {ID: "account", Address: "10.0.0.3", Port: 8080},
+	}
+
+	if subset := r.subset(instances); len(subset) != 2 {
+		t.Errorf("subset of %d instances, want 2", len(subset))
+	}
+}
+
+// recordingConsul is a TestConsul that records the time of every query
+type recordingConsul struct {
+	*coordinator.TestConsul
+
+	mu      sync.Mutex
+	queries []time.Time
+}
+
+func (c *recordingConsul) GetServices(ctx context.Context, name string, tag string) ([]*spec.Service, interface{}, error) {
+	c.mu.Lock()
+	c.queries = append(c.queries, time.Now())
+	c.mu.Unlock()
+
+	return c.TestConsul.GetServices(ctx, name, tag)
+}
+
+func (c *recordingConsul) gaps(n int) []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.queries) <= n {
+		return nil
+	}
+
+	gaps := make([]time.Duration, n)
+	for i := range gaps {
+		gaps[i] = c.queries[i+1].Sub(c.queries[i])
+	}
+
+	return gaps
+}
+
+func TestResolverBackoff(t *testing.T) {
+	r := &Resolver{minBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	d := r.minBackoff
+	for failures := 1; failures <= 8; failures++ {
+		for i := 0; i < 100; i++ {
+			if b := r.backoff(failures); b < d/2 || b > d {
+				t.Fatalf("backoff after %d failures = %v, want between %v and %v", failures, b, d/2, d)
+			}
+		}
+
+		d *= 2
+		if d > r.maxBackoff {
+			d = r.maxBackoff
+		}
+	}
+}
+
+func TestResolverBackoffOnRegistryErrors(t *testing.T) {
+	min, max := 20*time.Millisecond, 80*time.Millisecond
+	tc := &recordingConsul{TestConsul: &coordinator.TestConsul{GetServicesError: errors.New("connection refused")}}
+
+	r, err := newResolver(tc, "account", "", &logger.Logger{}, WithBackoff(min, max))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var gaps []time.Duration
+	for deadline := time.Now().Add(5 * time.Second); gaps == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the registry was not queried again")
+		}
+		gaps = tc.gaps(5)
+	}
+
+	// the delay doubles from min up to max, and is jittered down to half of it
+	d := min
+	for i, gap := range gaps {
+		if gap < d/2 || gap > d+100*time.Millisecond {
+			t.Errorf("query %d after %v, want between %v and %v", i+1, gap, d/2, d)
+		}
+
+		d *= 2
+		if d > max {
+			d = max
+		}
+	}
+}
+
+func TestResolverFlapping(t *testing.T) {
+	r := &Resolver{removeDelay: 50 * time.Millisecond}
+
+	a := &spec.Service{ID: "account-1", Address: "10.0.0.1", Port: 8080}
+	b := &spec.Service{ID: "account-2", Address: "10.0.0.2", Port: 8080}
+	both := map[string]*spec.Service{"10.0.0.1:8080": a, "10.0.0.2:8080": b}
+	removed := make(map[string]*removedInstance)
+
+	// b disappears and comes back within removeDelay
+	instances := r.debounce(both, map[string]*spec.Service{"10.0.0.1:8080": a}, removed)
+	if updates := r.makeUpdates(both, instances); len(updates) != 0 {
+		t.Fatalf("a flapping instance caused updates %v", updates)
+	}
+	next := r.debounce(instances, map[string]*spec.Service{"10.0.0.1:8080": a, "10.0.0.2:8080": b}, removed)
+	if updates := r.makeUpdates(instances, next); len(updates) != 0 {
+		t.Fatalf("a flapping instance caused updates %v", updates)
+	}
+
+	// b disappears for good
+	instances = r.debounce(next, map[string]*spec.Service{"10.0.0.1:8080": a}, removed)
+	time.Sleep(r.removeDelay)
+	last := r.debounce(instances, map[string]*spec.Service{"10.0.0.1:8080": a}, removed)
+	updates := r.makeUpdates(instances, last)
+	if len(updates) != 1 || updates[0].Op != naming.Delete || updates[0].Addr != "10.0.0.2:8080" {
+		t.Errorf("updates = %v, want b deleted after removeDelay", updates)
+	}
+}
+
+func TestResolverMinUpdateInterval(t *testing.T) {
+	r := &Resolver{
+		minUpdateInterval: 50 * time.Millisecond,
+		notify:            make(chan struct{}, 1),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+
+	a := &spec.Service{ID: "account-1", Address: "10.0.0.1", Port: 8080}
+	b := &spec.Service{ID: "account-2", Address: "10.0.0.2", Port: 8080}
+	sets := []map[string]*spec.Service{
+		{"10.0.0.1:8080": a},
+		{"10.0.0.1:8080": a, "10.0.0.2:8080": b},
+		{"10.0.0.2:8080": b},
+	}
+
+	var last time.Time
+	for i, set := range sets {
+		r.setCurrent(set)
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now()
+		if i > 0 && now.Sub(last) < r.minUpdateInterval {
+			t.Errorf("update %d %v after the previous one, want at least %v", i, now.Sub(last), r.minUpdateInterval)
+		}
+		last = now
+	}
+}
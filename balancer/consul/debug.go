@@ -0,0 +1,136 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+// DebugPath is the path of DebugHandler on the trace server, see
+// trace.Trace.Handle
+const DebugPath = "/debug/resolvers"
+
+// resolvers holds the live resolvers of the process
+var resolvers = struct {
+	sync.Mutex
+	m map[*Resolver]struct{}
+}{m: make(map[*Resolver]struct{})}
+
+// ResolverSnapshot describes what a Resolver believes the backend set is
+type ResolverSnapshot struct {
+	Service     string            `json:"service"`
+	Tag         string            `json:"tag,omitempty"`
+	Filter      string            `json:"filter,omitempty"`
+	Addresses   []AddressSnapshot `json:"addresses"`
+	LastIndex   uint64            `json:"last_index"`
+	LastError   string            `json:"last_error,omitempty"`
+	UpdateCount int               `json:"update_count"`
+	LastChange  time.Time         `json:"last_change"`
+}
+
+// AddressSnapshot describes a resolved address and its instance
+type AddressSnapshot struct {
+	Addr       string            `json:"addr"`
+	ID         string            `json:"id,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	Node       string            `json:"node,omitempty"`
+	Datacenter string            `json:"datacenter,omitempty"`
+}
+
+// registerResolver adds r to the live resolvers
+func registerResolver(r *Resolver) {
+	resolvers.Lock()
+	resolvers.m[r] = struct{}{}
+	resolvers.Unlock()
+}
+
+// unregisterResolver removes r from the live resolvers
+func unregisterResolver(r *Resolver) {
+	resolvers.Lock()
+	delete(resolvers.m, r)
+	resolvers.Unlock()
+}
+
+// Snapshot returns the current state of the resolver
+func (r *Resolver) Snapshot() ResolverSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := ResolverSnapshot{
+		Service:     r.service,
+		Tag:         r.tag,
+		Filter:      r.filter.String(),
+		Addresses:   make([]AddressSnapshot, 0, len(r.current)),
+		LastIndex:   r.lastIndex,
+		UpdateCount: r.updateCount,
+		LastChange:  r.lastUpdate,
+	}
+
+	if r.lastErr != nil {
+		s.LastError = r.lastErr.Error()
+	}
+
+	for addr, service := range r.current {
+		s.Addresses = append(s.Addresses, addressSnapshot(addr, service))
+	}
+	sort.Slice(s.Addresses, func(i, j int) bool {
+		return s.Addresses[i].Addr < s.Addresses[j].Addr
+	})
+
+	return s
+}
+
+// addressSnapshot returns the snapshot of an address
+func addressSnapshot(addr string, service *spec.Service) AddressSnapshot {
+	return AddressSnapshot{
+		Addr:       addr,
+		ID:         service.ID,
+		Tags:       service.Tags,
+		Meta:       service.Meta,
+		Node:       service.Node,
+		Datacenter: service.Datacenter,
+	}
+}
+
+// Snapshots returns the snapshots of all live resolvers of the process,
+// sorted by service and tag
+func Snapshots() []ResolverSnapshot {
+	resolvers.Lock()
+	live := make([]*Resolver, 0, len(resolvers.m))
+	for r := range resolvers.m {
+		live = append(live, r)
+	}
+	resolvers.Unlock()
+
+	snapshots := make([]ResolverSnapshot, len(live))
+	for i, r := range live {
+		snapshots[i] = r.Snapshot()
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Service == snapshots[j].Service {
+			return snapshots[i].Tag < snapshots[j].Tag
+		}
+		return snapshots[i].Service < snapshots[j].Service
+	})
+
+	return snapshots
+}
+
+// DebugHandler returns a http handler that writes Snapshots as JSON
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(Snapshots()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -1,74 +1,315 @@
 package consul
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/servicekit/servicekit-go/balancer"
 	"github.com/servicekit/servicekit-go/coordinator"
+	"github.com/servicekit/servicekit-go/filter"
 	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/spec"
 	"google.golang.org/grpc/naming"
 )
 
-type contextKey string
+const (
+	// DefaultMinBackoff is the first delay after a registry error
+	DefaultMinBackoff = time.Second
+	// DefaultMaxBackoff caps the delay after consecutive registry errors
+	DefaultMaxBackoff = 30 * time.Second
+	// DefaultMinUpdateInterval is the minimum interval between two updates
+	// returned by Next
+	DefaultMinUpdateInterval = time.Second
+	// DefaultRemoveDelay is the time an instance is kept after it
+	// disappeared from the registry
+	DefaultRemoveDelay = 3 * time.Second
 
-func (c contextKey) String() string {
-	return "mypackage context key " + string(c)
-}
+	// minQueryInterval is the minimum interval between two registry queries
+	minQueryInterval = time.Second
+	// maxWaitTime is the max time of a blocking query
+	maxWaitTime = 5 * time.Minute
+)
+
+// errResolverClosed is returned by Next once the resolver is closed
+var errResolverClosed = errors.New("Resolver: resolver is closed")
 
 // Resolver implements the gRPC Resolver interface using a Consul backend.
 //
 // See the gRPC load balancing documentation for details about Balancer and
 // Resolver: https://github.com/grpc/grpc/blob/master/doc/load-balancing.md.
+//
+// A single watch loop queries the registry, with blocking queries when the
+// coordinator is Consul. Registry errors are retried with a jittered
+// exponential backoff. Instances that disappear are kept for a while, so
+// that flapping instances do not churn connections. The loop only records
+// the latest set of instances, Next turns it into updates.
 type Resolver struct {
 	consul      coordinator.Coordinator
 	service     string
 	tag         string
+	filter      *filter.Filter
 	passingOnly bool
 
-	quitc    chan struct{}
-	updatesc chan []*naming.Update
+	subsetClientID string
+	subsetSize     int
+
+	fallbackAddrs []string
+	fallback      map[string]*spec.Service
+
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
+	minUpdateInterval time.Duration
+	removeDelay       time.Duration
+
+	mu          sync.Mutex
+	lastErr     error
+	errChanged  chan struct{}
+	lastIndex   uint64
+	current     map[string]*spec.Service
+	delivered   map[string]*spec.Service
+	lastUpdate  time.Time
+	updateCount int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	notify chan struct{}
+	done   chan struct{}
+	once   sync.Once
 
 	log *logger.Logger
 }
 
+// ResolverOption configures a Resolver
+type ResolverOption func(r *Resolver)
+
+// WithFilter selects the instances by a filter expression, see filter.Parse
+func WithFilter(f *filter.Filter) ResolverOption {
+	return func(r *Resolver) {
+		r.filter = f
+	}
+}
+
+// WithSubset connects to a stable subset of size instances only
+// The subset is chosen by clientID, which is usually the service ID of the
+// client, see balancer.Subset. A non-positive size disables subsetting.
+func WithSubset(clientID string, size int) ResolverOption {
+	return func(r *Resolver) {
+		r.subsetClientID = clientID
+		r.subsetSize = size
+	}
+}
+
+// WithFallback uses static addresses (host:port) when the registry is
+// unreachable and no instance was resolved before, or when the registry
+// returns no healthy instance
+func WithFallback(addrs ...string) ResolverOption {
+	return func(r *Resolver) {
+		r.fallbackAddrs = addrs
+	}
+}
+
+// WithBackoff sets the delays after registry errors
+// The delay doubles from min up to max with every consecutive error, and is
+// jittered so that clients do not retry in lockstep.
+func WithBackoff(min, max time.Duration) ResolverOption {
+	return func(r *Resolver) {
+		r.minBackoff = min
+		r.maxBackoff = max
+	}
+}
+
+// WithMinUpdateInterval sets the minimum interval between two updates
+// returned by Next, the changes in between are merged
+func WithMinUpdateInterval(d time.Duration) ResolverOption {
+	return func(r *Resolver) {
+		r.minUpdateInterval = d
+	}
+}
+
+// WithRemoveDelay keeps an instance for d after it disappeared from the
+// registry, an instance that comes back in time causes no update
+func WithRemoveDelay(d time.Duration) ResolverOption {
+	return func(r *Resolver) {
+		r.removeDelay = d
+	}
+}
+
 // NewResolver initializes and returns a new Resolver.
 //
 // It resolves addresses for gRPC connections to the given service and tag.
 // If the tag is irrelevant, use an empty string.
-func newResolver(consul coordinator.Coordinator, service, tag string, log *logger.Logger) (*Resolver, error) {
+func newResolver(consul coordinator.Coordinator, service, tag string, log *logger.Logger, opts ...ResolverOption) (*Resolver, error) {
 	r := &Resolver{
 		consul:      consul,
 		service:     service,
 		tag:         tag,
 		passingOnly: true,
-		quitc:       make(chan struct{}),
-		updatesc:    make(chan []*naming.Update, 1),
+
+		minBackoff:        DefaultMinBackoff,
+		maxBackoff:        DefaultMaxBackoff,
+		minUpdateInterval: DefaultMinUpdateInterval,
+		removeDelay:       DefaultRemoveDelay,
+
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		errChanged: make(chan struct{}),
 
 		log: log,
 	}
 
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	fallback, err := r.makeFallback()
+	if err != nil {
+		return nil, err
+	}
+	r.fallback = fallback
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
 	// Retrieve instances immediately
-	instances, index, err := r.getInstances(0)
+	instances, index, err := r.getInstances(r.ctx, 0, 0)
 	if err != nil {
 		r.log.Warnf("Resolver: error retrieving instances from Consul: %v", err)
 	}
-	fmt.Println(instances)
-	updates := r.makeUpdates(nil, instances)
-	if len(updates) > 0 {
-		r.updatesc <- updates
-	}
+	instances = r.resolved(nil, instances, err)
+	r.log.Debugf("Resolver: service %s resolved %d instances", r.service, len(instances))
+	r.setCurrent(instances)
+	r.setIndex(index)
 
 	// Start updater
-	go r.updater(instances, index)
+	go r.updater(instances, index, err != nil)
+
+	registerResolver(r)
 
 	return r, nil
 }
 
+// makeFallback returns the instances of the fallback addresses
+func (r *Resolver) makeFallback() (map[string]*spec.Service, error) {
+	fallback := make(map[string]*spec.Service, len(r.fallbackAddrs))
+	for _, addr := range r.fallbackAddrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Resolver: invalid fallback address %s: %v", addr, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("Resolver: invalid fallback address %s: %v", addr, err)
+		}
+		fallback[addr] = &spec.Service{
+			ID:      addr,
+			Service: r.service,
+			Address: host,
+			Port:    p,
+		}
+	}
+
+	return fallback, nil
+}
+
+// resolved returns the instances to use after the registry returned
+// instances or err, and records the error
+// The last resolved instances are kept while the registry is unreachable,
+// the fallback instances are used when there are none.
+func (r *Resolver) resolved(oldInstances, instances map[string]*spec.Service, err error) map[string]*spec.Service {
+	if err != nil {
+		r.setErr(fmt.Errorf("no backends for service %s: registry error: %v", r.service, err))
+		if len(oldInstances) > 0 {
+			return oldInstances
+		}
+		return r.getFallback()
+	}
+
+	if len(instances) == 0 {
+		r.setErr(fmt.Errorf("no backends for service %s: registry returned no healthy instance", r.service))
+		return r.getFallback()
+	}
+
+	r.setErr(nil)
+
+	return instances
+}
+
+// getFallback returns a copy of the fallback instances
+func (r *Resolver) getFallback() map[string]*spec.Service {
+	fallback := make(map[string]*spec.Service, len(r.fallback))
+	for addr, service := range r.fallback {
+		fallback[addr] = service
+	}
+
+	return fallback
+}
+
+// setErr records the last resolution error, and wakes up the callers of
+// ErrChanged when the resolution starts or stops failing
+func (r *Resolver) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := (err == nil) != (r.lastErr == nil)
+	r.lastErr = err
+	if changed {
+		close(r.errChanged)
+		r.errChanged = make(chan struct{})
+	}
+}
+
+// ErrChanged returns a channel that is closed when the resolution starts or
+// stops failing, or when the resolver is closed
+// It implements balancer.ErrorWatcher.
+func (r *Resolver) ErrChanged() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.errChanged
+}
+
+// Err returns the last resolution error, or nil when the last resolution
+// succeeded
+// It implements balancer.ErrorWatcher, so that RPCs fail with this error
+// when there is no backend at all.
+func (r *Resolver) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lastErr
+}
+
+// setIndex records the last index returned from Consul
+func (r *Resolver) setIndex(index uint64) {
+	r.mu.Lock()
+	r.lastIndex = index
+	r.mu.Unlock()
+}
+
+// setCurrent records a copy of the latest set of instances and wakes up Next
+func (r *Resolver) setCurrent(instances map[string]*spec.Service) {
+	current := make(map[string]*spec.Service, len(instances))
+	for addr, service := range instances {
+		current[addr] = service
+	}
+
+	r.mu.Lock()
+	r.current = current
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
 // Resolve creates a watcher for target. The watcher interface is implemented
 // by Resolver as well, see Next and Close.
 func (r *Resolver) Resolve(target string) (naming.Watcher, error) {
@@ -79,107 +320,283 @@ func (r *Resolver) Resolve(target string) (naming.Watcher, error) {
 // updates. The first call will return the full set of instances available
 // as NewConsulResolver will look those up. Subsequent calls to Next() will
 // block until the resolver finds any new or removed instance.
+// Changes within the minimum update interval are returned together.
 //
-// An error is returned if and only if the watcher cannot recover.
+// An error is returned if and only if the watcher cannot recover, which
+// only happens once it is closed: registry errors are reported by Err.
 func (r *Resolver) Next() ([]*naming.Update, error) {
-	return <-r.updatesc, nil
+	for {
+		select {
+		case <-r.ctx.Done():
+			return nil, errResolverClosed
+		case <-r.notify:
+		}
+
+		r.mu.Lock()
+		wait := r.minUpdateInterval - time.Since(r.lastUpdate)
+		r.mu.Unlock()
+
+		if wait > 0 {
+			select {
+			case <-r.ctx.Done():
+				return nil, errResolverClosed
+			case <-time.After(wait):
+			}
+		}
+
+		r.mu.Lock()
+		updates := r.makeUpdates(r.delivered, r.current)
+		r.delivered = r.current
+		if len(updates) > 0 {
+			r.lastUpdate = time.Now()
+			r.updateCount++
+		}
+		r.mu.Unlock()
+
+		if len(updates) > 0 {
+			return updates, nil
+		}
+	}
 }
 
 // Close closes the watcher.
+// It stops the watch loop and waits for it to exit, Next returns an error
+// afterwards. Close can be called more than once.
 func (r *Resolver) Close() {
-	select {
-	case <-r.quitc:
-	default:
-		close(r.quitc)
-		close(r.updatesc)
-	}
+	r.once.Do(func() {
+		unregisterResolver(r)
+		r.cancel()
+		<-r.done
+
+		r.mu.Lock()
+		close(r.errChanged)
+		r.mu.Unlock()
+	})
 }
 
-// updater is a background process started in NewResolver. It takes
-// a list of previously resolved instances (in the format of host:port, e.g.
-// 192.168.0.1:1234) and the last index returned from Consul.
-func (r *Resolver) updater(instances []string, lastIndex uint64) {
-	var err error
-	var oldInstances = instances
-	var newInstances []string
+// updater is the watch loop started in NewResolver. It takes a set of
+// previously resolved instances (keyed by host:port, e.g. 192.168.0.1:1234),
+// the last index returned from Consul and whether the last query failed.
+func (r *Resolver) updater(instances map[string]*spec.Service, lastIndex uint64, failed bool) {
+	defer close(r.done)
+
+	var (
+		failures  int
+		lastQuery = time.Now()
+		removed   = make(map[string]*removedInstance)
+	)
+
+	if failed {
+		failures = 1
+	}
 
-	// TODO Cache the updates for a while, so that we don't overwhelm Consul.
 	for {
-		select {
-		case <-r.quitc:
-			break
-		default:
-			newInstances, lastIndex, err = r.getInstances(lastIndex)
-			if err != nil {
-				r.log.Debugf("grpc/lb: error retrieving instances from Consul: %v", err)
-				time.Sleep(1 * time.Second)
-				continue
+		// Wait before the next query, so that we don't overwhelm Consul
+		wait := minQueryInterval - time.Since(lastQuery)
+		if failures > 0 {
+			wait = r.backoff(failures)
+		}
+		if wait > 0 {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		// A blocking query must return in time to drop removed instances
+		waitTime := maxWaitTime
+		for _, ri := range removed {
+			if d := time.Until(ri.removeAt); d < waitTime {
+				waitTime = d
 			}
-			updates := r.makeUpdates(oldInstances, newInstances)
-			if len(updates) > 0 {
-				r.updatesc <- updates
+		}
+		if waitTime < minQueryInterval {
+			waitTime = minQueryInterval
+		}
+
+		lastQuery = time.Now()
+		newInstances, index, err := r.getInstances(r.ctx, lastIndex, waitTime)
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			failures++
+			r.log.Debugf("grpc/lb: error retrieving instances from Consul: %v", err)
+		} else {
+			failures = 0
+			// Consul may reset its index, start over then
+			if index < lastIndex {
+				index = 0
 			}
-			oldInstances = newInstances
-			time.Sleep(1 * time.Second)
+			lastIndex = index
+			r.setIndex(index)
+			newInstances = r.debounce(instances, newInstances, removed)
 		}
+
+		instances = r.resolved(instances, newInstances, err)
+		r.setCurrent(instances)
 	}
 }
 
-// getInstances retrieves the new set of instances registered for the
-// service from Consul.
-func (r *Resolver) getInstances(lastIndex uint64) ([]string, uint64, error) {
-	ctx := context.Background()
+// removedInstance is an instance that disappeared from the registry
+type removedInstance struct {
+	service  *spec.Service
+	removeAt time.Time
+}
+
+// debounce returns newInstances plus the instances of oldInstances that
+// disappeared less than removeDelay ago
+func (r *Resolver) debounce(oldInstances, newInstances map[string]*spec.Service, removed map[string]*removedInstance) map[string]*spec.Service {
+	if r.removeDelay <= 0 || len(newInstances) == 0 {
+		return newInstances
+	}
+
+	now := time.Now()
+
+	for addr := range removed {
+		if _, ok := newInstances[addr]; ok {
+			delete(removed, addr)
+		}
+	}
 
-	context.WithValue(ctx, contextKey("passingOnly"), true)
-	context.WithValue(ctx, contextKey("queryOptions"), &api.QueryOptions{
+	for addr, service := range oldInstances {
+		if _, ok := newInstances[addr]; ok {
+			continue
+		}
+		if _, ok := removed[addr]; ok == false {
+			removed[addr] = &removedInstance{service: service, removeAt: now.Add(r.removeDelay)}
+		}
+	}
+
+	instances := make(map[string]*spec.Service, len(newInstances)+len(removed))
+	for addr, service := range newInstances {
+		instances[addr] = service
+	}
+	for addr, ri := range removed {
+		if now.Before(ri.removeAt) {
+			instances[addr] = ri.service
+			continue
+		}
+		delete(removed, addr)
+	}
+
+	return instances
+}
+
+// backoff returns the jittered delay after failures consecutive errors
+func (r *Resolver) backoff(failures int) time.Duration {
+	d := r.minBackoff
+	for i := 1; i < failures && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	// between half and the full delay
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// getInstances retrieves the new set of instances registered for the
+// service from Consul, keyed by host:port.
+// When the coordinator is Consul and lastIndex is not zero, it blocks until
+// the set changes, waitTime elapses or ctx is done. Other coordinators are
+// polled.
+func (r *Resolver) getInstances(ctx context.Context, lastIndex uint64, waitTime time.Duration) (map[string]*spec.Service, uint64, error) {
+	queryOptions := &api.QueryOptions{
 		WaitIndex: lastIndex,
-	})
-	services, meta, err := r.consul.GetServices(ctx, r.service, r.tag)
+		WaitTime:  waitTime,
+	}
+
+	ctx = context.WithValue(ctx, "passingOnly", r.passingOnly)
+	ctx = context.WithValue(ctx, "queryOptions", queryOptions.WithContext(ctx))
+
+	services, meta, err := coordinator.GetServices(ctx, r.consul, r.service, r.tag, r.filter)
 	if err != nil {
 		return nil, lastIndex, err
 	}
 
-	_m, ok := meta.(*api.QueryMeta)
-	if ok == false {
-		return nil, lastIndex, fmt.Errorf("invalid meta data")
+	var index uint64
+	if m, ok := meta.(*api.QueryMeta); ok && m != nil {
+		index = m.LastIndex
 	}
 
-	var instances []string
+	instances := make(map[string]*spec.Service, len(services))
 	for _, service := range services {
 		s := service.Address
 		if len(s) == 0 {
 			s = service.NodeAddress
 		}
 		addr := net.JoinHostPort(s, strconv.Itoa(service.Port))
-		instances = append(instances, addr)
+		instances[addr] = service
 	}
-	return instances, _m.LastIndex, nil
+
+	return r.subset(instances), index, nil
 }
 
-// makeUpdates calculates the difference between and old and a new set of
-// instances and turns it into an array of naming.Updates.
-func (r *Resolver) makeUpdates(oldInstances, newInstances []string) []*naming.Update {
-	oldAddr := make(map[string]struct{}, len(oldInstances))
-	for _, instance := range oldInstances {
-		oldAddr[instance] = struct{}{}
+// subset returns the subset of instances used by the client
+// Instances are keyed by address, service IDs are only unique per agent.
+func (r *Resolver) subset(instances map[string]*spec.Service) map[string]*spec.Service {
+	if r.subsetSize <= 0 || len(instances) <= r.subsetSize {
+		return instances
 	}
-	newAddr := make(map[string]struct{}, len(newInstances))
-	for _, instance := range newInstances {
-		newAddr[instance] = struct{}{}
+
+	addrs := make([]string, 0, len(instances))
+	for addr := range instances {
+		addrs = append(addrs, addr)
+	}
+
+	subset := make(map[string]*spec.Service, r.subsetSize)
+	for _, addr := range balancer.Subset(r.subsetClientID, addrs, r.subsetSize) {
+		subset[addr] = instances[addr]
 	}
 
+	return subset
+}
+
+// makeUpdates calculates the difference between and old and a new set of
+// instances and turns it into an array of naming.Updates.
+// The Metadata of every update is the *spec.Service of the instance. An
+// instance whose tags changed is added again without being deleted, so that
+// balancers update its metadata but keep its connection. Unchanged
+// instances keep their old metadata in newInstances, so that a later Delete
+// carries the same Metadata as the last Add.
+func (r *Resolver) makeUpdates(oldInstances, newInstances map[string]*spec.Service) []*naming.Update {
 	var updates []*naming.Update
-	for addr := range newAddr {
-		if _, ok := oldAddr[addr]; !ok {
-			updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr})
+	for addr, service := range newInstances {
+		old, ok := oldInstances[addr]
+		if ok && sameTags(old.Tags, service.Tags) {
+			newInstances[addr] = old
+			continue
 		}
+		updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr, Metadata: service})
 	}
-	for addr := range oldAddr {
-		if _, ok := newAddr[addr]; !ok {
-			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr})
+	for addr, service := range oldInstances {
+		if _, ok := newInstances[addr]; !ok {
+			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr, Metadata: service})
 		}
 	}
 
 	return updates
 
 }
+
+// sameTags returns true when a and b hold the same tags in the same order
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
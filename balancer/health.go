@@ -0,0 +1,266 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultHealthCheckInterval is the interval of Check probes, used when
+	// the backend does not implement Watch
+	DefaultHealthCheckInterval = 5 * time.Second
+	// maxHealthCheckBackoff caps the delay between two failed probes
+	maxHealthCheckBackoff = 30 * time.Second
+)
+
+// HealthChecker probes every backend of a RoundRobin with the standard
+// grpc.health.v1 service and reports the backends that are NOT_SERVING
+// Probes are sent on the balanced connection itself, pinned to each backend,
+// so no extra connection is made. Client interceptors should let probes
+// through untouched, see IsHealthProbe. A backend that does not register the
+// health service is considered serving; a backend whose probes fail keeps
+// its last known status.
+type HealthChecker struct {
+	service  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cc      *grpc.ClientConn
+	probes  map[string]context.CancelFunc
+	serving map[string]bool
+	closed  bool
+}
+
+// NewHealthChecker returns a HealthChecker that probes the health of service,
+// use an empty string for the overall health of the server
+func NewHealthChecker(service string) *HealthChecker {
+	return &HealthChecker{
+		service:  service,
+		interval: DefaultHealthCheckInterval,
+		probes:   make(map[string]context.CancelFunc),
+		serving:  make(map[string]bool),
+	}
+}
+
+// Start starts probing the backends through cc
+// cc must be balanced by a RoundRobin that uses the checker
+func (h *HealthChecker) Start(cc *grpc.ClientConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || h.cc != nil {
+		return
+	}
+
+	h.cc = cc
+	for addr := range h.probes {
+		h.probes[addr] = h.probe(addr)
+	}
+}
+
+// SetBackends replaces the set of probed backends
+func (h *HealthChecker) SetBackends(addrs []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	present := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		present[addr] = struct{}{}
+		if _, ok := h.probes[addr]; ok {
+			continue
+		}
+		h.probes[addr] = h.probe(addr)
+	}
+
+	for addr, cancel := range h.probes {
+		if _, ok := present[addr]; ok {
+			continue
+		}
+		if cancel != nil {
+			cancel()
+		}
+		delete(h.probes, addr)
+		delete(h.serving, addr)
+	}
+}
+
+// Serving returns false when addr reported NOT_SERVING
+// Backends that were not probed yet are considered serving.
+func (h *HealthChecker) Serving(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	serving, ok := h.serving[addr]
+
+	return ok == false || serving
+}
+
+// Close stops all probes
+func (h *HealthChecker) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for addr, cancel := range h.probes {
+		if cancel != nil {
+			cancel()
+		}
+		delete(h.probes, addr)
+	}
+}
+
+// probe starts probing addr, it must be called with h.mu held
+// It returns nil when the checker is not started yet.
+func (h *HealthChecker) probe(addr string) context.CancelFunc {
+	if h.cc == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go h.watch(withPinnedAddr(ctx, addr), addr, healthpb.NewHealthClient(h.cc))
+
+	return cancel
+}
+
+// set records the serving status of addr
+func (h *HealthChecker) set(addr string, serving bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.probes[addr]; ok {
+		h.serving[addr] = serving
+	}
+}
+
+// unset forgets the serving status of addr
+func (h *HealthChecker) unset(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.serving, addr)
+}
+
+// watch probes addr until ctx is done
+// It uses Watch, and falls back to Check polling when Watch is unimplemented.
+func (h *HealthChecker) watch(ctx context.Context, addr string, client healthpb.HealthClient) {
+	backoff := time.Second
+	useWatch := true
+
+	for {
+		var err error
+		var received bool
+		if useWatch {
+			received, err = h.watchOnce(ctx, addr, client)
+		} else {
+			received, err = h.checkOnce(ctx, addr, client)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if status.Code(err) == codes.Unimplemented {
+			if useWatch {
+				useWatch = false
+				continue
+			}
+			// no health service, the backend is considered serving
+			h.unset(addr)
+			return
+		}
+
+		// Other errors, e.g. PermissionDenied or a broken connection, keep
+		// the last known status; the connection state tells whether a
+		// broken backend is usable
+		if received {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxHealthCheckBackoff {
+			backoff = maxHealthCheckBackoff
+		}
+	}
+}
+
+// watchOnce receives the statuses of a Watch stream until it fails
+func (h *HealthChecker) watchOnce(ctx context.Context, addr string, client healthpb.HealthClient) (bool, error) {
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: h.service}, grpc.FailFast(false))
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+
+		received = true
+		h.set(addr, resp.Status == healthpb.HealthCheckResponse_SERVING)
+	}
+}
+
+// checkOnce polls Check every interval until it fails
+func (h *HealthChecker) checkOnce(ctx context.Context, addr string, client healthpb.HealthClient) (bool, error) {
+	received := false
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, h.interval)
+		resp, err := client.Check(checkCtx, &healthpb.HealthCheckRequest{Service: h.service}, grpc.FailFast(false))
+		cancel()
+		if err != nil {
+			return received, err
+		}
+
+		received = true
+		h.set(addr, resp.Status == healthpb.HealthCheckResponse_SERVING)
+
+		select {
+		case <-ctx.Done():
+			return received, ctx.Err()
+		case <-time.After(h.interval):
+		}
+	}
+}
+
+type pinnedAddrKey struct{}
+
+// withPinnedAddr returns a context whose calls are sent to addr
+func withPinnedAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, pinnedAddrKey{}, addr)
+}
+
+// IsHealthProbe returns true when ctx is the context of a probe of a
+// HealthChecker
+// Client interceptors pass probes through as they are: probes must not be
+// logged, measured, given a deadline or faulted, and Watch streams are long
+// lived.
+func IsHealthProbe(ctx context.Context) bool {
+	_, ok := pinnedAddr(ctx)
+
+	return ok
+}
+
+// pinnedAddr returns the address the call of ctx is pinned to
+func pinnedAddr(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(pinnedAddrKey{}).(string)
+
+	return addr, ok
+}
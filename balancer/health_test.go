@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/status"
+)
+
+// testHealthClient is a healthpb.HealthClient whose Watch streams send
+// statuses and then fail with err, and whose Check fails with checkErr
+type testHealthClient struct {
+	statuses []healthpb.HealthCheckResponse_ServingStatus
+	err      error
+	checkErr error
+}
+
+func (c *testHealthClient) Check(ctx context.Context, in *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (*healthpb.HealthCheckResponse, error) {
+	return nil, c.checkErr
+}
+
+func (c *testHealthClient) Watch(ctx context.Context, in *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (healthpb.Health_WatchClient, error) {
+	return &testWatchClient{statuses: c.statuses, err: c.err}, nil
+}
+
+type testWatchClient struct {
+	grpc.ClientStream
+
+	statuses []healthpb.HealthCheckResponse_ServingStatus
+	err      error
+}
+
+func (s *testWatchClient) Recv() (*healthpb.HealthCheckResponse, error) {
+	if len(s.statuses) == 0 {
+		return nil, s.err
+	}
+
+	resp := &healthpb.HealthCheckResponse{Status: s.statuses[0]}
+	s.statuses = s.statuses[1:]
+
+	return resp, nil
+}
+
+func TestHealthCheckerWatch(t *testing.T) {
+	notServing := []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_NOT_SERVING}
+
+	tests := []struct {
+		name    string
+		client  *testHealthClient
+		serving bool
+	}{
+		{"not serving", &testHealthClient{statuses: notServing, err: status.Error(codes.Unavailable, "closing")}, false},
+		{"denied probe keeps the status", &testHealthClient{statuses: notServing, err: status.Error(codes.PermissionDenied, "denied")}, false},
+		{"deadline keeps the status", &testHealthClient{statuses: notServing, err: status.Error(codes.DeadlineExceeded, "deadline")}, false},
+		{"no health service", &testHealthClient{err: status.Error(codes.Unimplemented, "no watch"), checkErr: status.Error(codes.Unimplemented, "no check")}, true},
+	}
+
+	for _, tt := range tests {
+		h := NewHealthChecker("")
+		h.probes["a"] = nil
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		h.watch(ctx, "a", tt.client)
+		cancel()
+
+		if h.Serving("a") != tt.serving {
+			t.Errorf("%s: serving = %v, want %v", tt.name, h.Serving("a"), tt.serving)
+		}
+	}
+}
+
+func TestRoundRobinHealth(t *testing.T) {
+	h := NewHealthChecker("")
+
+	w := newTestWatcher()
+	rr := NewRoundRobin(w, nil, WithHealthChecker(h))
+	if err := rr.Start("a", grpc.BalancerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	w.send(t, rr, &naming.Update{Op: naming.Add, Addr: "a:1"}, &naming.Update{Op: naming.Add, Addr: "b:1"})
+	rr.Up(grpc.Address{Addr: "a:1"})
+	rr.Up(grpc.Address{Addr: "b:1"})
+	h.set("a:1", false)
+
+	get := func(ctx context.Context) string {
+		addr, _, err := rr.Get(ctx, grpc.BalancerGetOptions{BlockingWait: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr.Addr
+	}
+
+	for i := 0; i < 4; i++ {
+		if addr := get(context.Background()); addr != "b:1" {
+			t.Fatalf("NOT_SERVING address %s was picked", addr)
+		}
+	}
+
+	// probes go to the address they are pinned to, even NOT_SERVING
+	ctx := withPinnedAddr(context.Background(), "a:1")
+	if IsHealthProbe(ctx) == false {
+		t.Fatal("a pinned context should be a health probe")
+	}
+	for i := 0; i < 2; i++ {
+		if addr := get(ctx); addr != "a:1" {
+			t.Fatalf("probe of a:1 was sent to %s", addr)
+		}
+	}
+
+	// the NOT_SERVING address is used when no other is available
+	h.set("b:1", false)
+	if addr := get(context.Background()); addr == "" {
+		t.Fatal("no address was picked")
+	}
+}
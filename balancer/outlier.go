@@ -0,0 +1,377 @@
+package balancer
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultConsecutiveErrors is the count of consecutive errors that ejects a backend
+	DefaultConsecutiveErrors = 5
+	// DefaultBaseEjectionTime is the ejection time of the first ejection
+	DefaultBaseEjectionTime = 30 * time.Second
+	// DefaultMaxEjectionTime caps the exponential ejection time
+	DefaultMaxEjectionTime = 5 * time.Minute
+	// DefaultMaxEjectionPercent is the max percentage of backends that can be ejected
+	DefaultMaxEjectionPercent = 50
+	// DefaultLatencyFactor ejects a backend which latency is greater than
+	// DefaultLatencyFactor times the median latency of all backends
+	DefaultLatencyFactor = 3.0
+	// DefaultMinRequests is the count of calls before latency of a backend is judged
+	DefaultMinRequests = 20
+)
+
+// OutlierConfig configures an OutlierDetector
+type OutlierConfig struct {
+	// ConsecutiveErrors ejects a backend after this count of consecutive failures
+	ConsecutiveErrors int
+	// BaseEjectionTime is doubled on every ejection of the same backend
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime caps the ejection time
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent caps the percentage of ejected backends
+	MaxEjectionPercent int
+	// LatencyFactor ejects a backend which average latency is greater than
+	// LatencyFactor times the median; a negative value disables latency detection
+	LatencyFactor float64
+	// MinRequests is the count of calls before latency of a backend is judged
+	MinRequests int
+	// IsFailure returns true when err counts as a failure of the backend,
+	// by default gRPC Unavailable and Internal errors do
+	IsFailure func(err error) bool
+}
+
+// DefaultOutlierConfig returns an OutlierConfig with default values
+func DefaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		ConsecutiveErrors:  DefaultConsecutiveErrors,
+		BaseEjectionTime:   DefaultBaseEjectionTime,
+		MaxEjectionTime:    DefaultMaxEjectionTime,
+		MaxEjectionPercent: DefaultMaxEjectionPercent,
+		LatencyFactor:      DefaultLatencyFactor,
+		MinRequests:        DefaultMinRequests,
+		IsFailure:          IsBackendFailure,
+	}
+}
+
+// IsBackendFailure returns true when err is a gRPC Unavailable or Internal error
+func IsBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal:
+		return true
+	}
+
+	return false
+}
+
+// backendStats describes the outcomes of calls to a backend
+type backendStats struct {
+	consecutiveErrors int
+	requests          int
+	latency           float64
+
+	ejections    int
+	ejectedAt    time.Time
+	ejectedUntil time.Time
+}
+
+// OutlierDetector tracks the outcomes of calls per backend and temporarily
+// ejects the backends that fail or are slow
+// A backend is ejected after ConsecutiveErrors consecutive failures, or when
+// its average latency is an outlier. The ejection time grows exponentially
+// with every ejection of the same backend.
+type OutlierDetector struct {
+	config OutlierConfig
+
+	mu       sync.Mutex
+	backends map[string]*backendStats
+
+	now func() time.Time
+}
+
+// NewOutlierDetector returns an OutlierDetector
+// Zero values of config are replaced by defaults
+func NewOutlierDetector(config OutlierConfig) *OutlierDetector {
+	d := DefaultOutlierConfig()
+	if config.ConsecutiveErrors > 0 {
+		d.ConsecutiveErrors = config.ConsecutiveErrors
+	}
+	if config.BaseEjectionTime > 0 {
+		d.BaseEjectionTime = config.BaseEjectionTime
+	}
+	if config.MaxEjectionTime > 0 {
+		d.MaxEjectionTime = config.MaxEjectionTime
+	}
+	if config.MaxEjectionPercent > 0 {
+		d.MaxEjectionPercent = config.MaxEjectionPercent
+	}
+	if config.LatencyFactor != 0 {
+		d.LatencyFactor = config.LatencyFactor
+	}
+	if config.MinRequests > 0 {
+		d.MinRequests = config.MinRequests
+	}
+	if config.IsFailure != nil {
+		d.IsFailure = config.IsFailure
+	}
+
+	return &OutlierDetector{
+		config:   d,
+		backends: make(map[string]*backendStats),
+		now:      time.Now,
+	}
+}
+
+// SetBackends replaces the set of tracked backends
+// Stats of the backends that are still present are kept
+func (d *OutlierDetector) SetBackends(addrs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	backends := make(map[string]*backendStats, len(addrs))
+	for _, addr := range addrs {
+		if b, ok := d.backends[addr]; ok {
+			backends[addr] = b
+			continue
+		}
+		backends[addr] = &backendStats{}
+	}
+
+	d.backends = backends
+}
+
+// Ejected returns true when addr is ejected
+func (d *OutlierDetector) Ejected(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := d.backends[addr]
+	if ok == false {
+		return false
+	}
+
+	return d.now().Before(b.ejectedUntil)
+}
+
+// Report records the outcome of a call to addr
+func (d *OutlierDetector) Report(addr string, err error, latency time.Duration) {
+	d.report(addr, err, latency, true)
+}
+
+// ReportError records the outcome of a call to addr whose latency is not
+// judged, e.g. a stream, whose lifetime is not a latency
+func (d *OutlierDetector) ReportError(addr string, err error) {
+	d.report(addr, err, 0, false)
+}
+
+// report records the outcome of a call to addr, and its latency when
+// sample is true
+func (d *OutlierDetector) report(addr string, err error, latency time.Duration, sample bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := d.backends[addr]
+	if ok == false {
+		b = &backendStats{}
+		d.backends[addr] = b
+	}
+
+	now := d.now()
+	if now.Before(b.ejectedUntil) {
+		return
+	}
+
+	// A backend that stayed healthy long enough starts over
+	if b.ejections > 0 && now.Sub(b.ejectedUntil) > d.config.MaxEjectionTime {
+		b.ejections = 0
+	}
+
+	if err != nil && d.config.IsFailure(err) {
+		b.consecutiveErrors++
+		if b.consecutiveErrors >= d.config.ConsecutiveErrors {
+			d.eject(b, now)
+		}
+		return
+	}
+
+	b.consecutiveErrors = 0
+	if sample == false {
+		return
+	}
+
+	b.requests++
+	if b.requests == 1 {
+		b.latency = float64(latency)
+	} else {
+		// exponentially weighted moving average
+		b.latency = 0.9*b.latency + 0.1*float64(latency)
+	}
+
+	if d.config.LatencyFactor > 0 && b.requests >= d.config.MinRequests {
+		if median, ok := d.medianLatency(); ok && b.latency > d.config.LatencyFactor*median {
+			d.eject(b, now)
+		}
+	}
+}
+
+// medianLatency returns the median of the average latencies of the
+// backends that have enough requests, at least three are required
+func (d *OutlierDetector) medianLatency() (float64, bool) {
+	var latencies []float64
+	for _, b := range d.backends {
+		if b.requests >= d.config.MinRequests {
+			latencies = append(latencies, b.latency)
+		}
+	}
+
+	if len(latencies) < 3 {
+		return 0, false
+	}
+
+	sort.Float64s(latencies)
+
+	return latencies[len(latencies)/2], true
+}
+
+// eject ejects b unless too many backends are ejected already
+func (d *OutlierDetector) eject(b *backendStats, now time.Time) {
+	ejected := 0
+	for _, o := range d.backends {
+		if now.Before(o.ejectedUntil) {
+			ejected++
+		}
+	}
+
+	if (ejected+1)*100 > len(d.backends)*d.config.MaxEjectionPercent {
+		return
+	}
+
+	ejection := d.config.BaseEjectionTime
+	for i := 0; i < b.ejections && ejection < d.config.MaxEjectionTime; i++ {
+		ejection *= 2
+	}
+	if ejection > d.config.MaxEjectionTime {
+		ejection = d.config.MaxEjectionTime
+	}
+
+	b.ejections++
+	b.ejectedAt = now
+	b.ejectedUntil = now.Add(ejection)
+	b.consecutiveErrors = 0
+	b.requests = 0
+	b.latency = 0
+}
+
+// UnaryClientInterceptor returns a grpc.UnaryClientInterceptor that reports
+// the outcome of every call to the detector
+// The connection must be balanced by a RoundRobin that uses the detector.
+func (d *OutlierDetector) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if IsHealthProbe(ctx) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		ctx, p := withPick(ctx)
+
+		startTime := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		if addr := p.get(); addr != "" {
+			d.Report(addr, err, time.Now().Sub(startTime))
+		}
+
+		return err
+	}
+}
+
+// StreamClientInterceptor returns a grpc.StreamClientInterceptor that
+// reports the outcome of every stream to the detector
+// Only the errors of streams are reported: streams, e.g. watches, may live
+// long, so that their duration tells nothing of the latency of a backend.
+func (d *OutlierDetector) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if IsHealthProbe(ctx) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		ctx, p := withPick(ctx)
+
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			if addr := p.get(); addr != "" {
+				d.ReportError(addr, err)
+			}
+			return nil, err
+		}
+
+		return &outlierClientStream{ClientStream: s, d: d, p: p}, nil
+	}
+}
+
+// outlierClientStream reports the outcome of a stream when it ends
+type outlierClientStream struct {
+	grpc.ClientStream
+
+	d    *OutlierDetector
+	p    *pick
+	once sync.Once
+}
+
+func (s *outlierClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			result := err
+			if result == io.EOF {
+				result = nil
+			}
+			if addr := s.p.get(); addr != "" {
+				s.d.ReportError(addr, result)
+			}
+		})
+	}
+
+	return err
+}
+
+type pickKey struct{}
+
+// pick records the address picked by RoundRobin for a call
+type pick struct {
+	mu   sync.Mutex
+	addr string
+}
+
+func (p *pick) set(addr string) {
+	p.mu.Lock()
+	p.addr = addr
+	p.mu.Unlock()
+}
+
+func (p *pick) get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.addr
+}
+
+// withPick returns a context that records the address picked for a call
+func withPick(ctx context.Context) (context.Context, *pick) {
+	p := &pick{}
+
+	return context.WithValue(ctx, pickKey{}, p), p
+}
+
+// recordPick records addr as the address picked for the call of ctx
+func recordPick(ctx context.Context, addr string) {
+	if p, ok := ctx.Value(pickKey{}).(*pick); ok {
+		p.set(addr)
+	}
+}
@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOutlierDetectorEjection(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	d := NewOutlierDetector(OutlierConfig{
+		ConsecutiveErrors: 3,
+		BaseEjectionTime:  time.Second,
+		MaxEjectionTime:   3 * time.Second,
+		LatencyFactor:     -1,
+	})
+	d.now = func() time.Time { return now }
+	d.SetBackends([]string{"a", "b", "c", "d"})
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+
+	for i := 0; i < 3; i++ {
+		d.Report("b", status.Error(codes.NotFound, "not found"), time.Millisecond)
+		d.Report("a", unavailable, time.Millisecond)
+	}
+	if d.Ejected("a") == false || d.Ejected("b") {
+		t.Fatal("a should be ejected, b should not")
+	}
+
+	for i := 0; i < 3; i++ {
+		d.Report("c", unavailable, time.Millisecond)
+		d.Report("d", unavailable, time.Millisecond)
+	}
+	if d.Ejected("c") == false || d.Ejected("d") {
+		t.Fatal("max ejection percent should keep d")
+	}
+
+	// the second ejection of a lasts twice as long
+	now = now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		d.Report("a", unavailable, time.Millisecond)
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if d.Ejected("a") == false {
+		t.Fatal("a should still be ejected")
+	}
+	now = now.Add(time.Second)
+	if d.Ejected("a") {
+		t.Fatal("a should be back")
+	}
+}
+
+func TestOutlierDetectorLatency(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{MinRequests: 5, LatencyFactor: 3})
+	d.SetBackends([]string{"a", "b", "c", "slow"})
+
+	for i := 0; i < 5; i++ {
+		d.Report("a", nil, 10*time.Millisecond)
+		d.Report("b", nil, 12*time.Millisecond)
+		d.Report("c", nil, 8*time.Millisecond)
+		d.Report("slow", nil, 100*time.Millisecond)
+	}
+
+	if d.Ejected("slow") == false {
+		t.Error("the slow backend should be ejected")
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if d.Ejected(addr) {
+			t.Errorf("the fast backend %s should not be ejected", addr)
+		}
+	}
+}
+
+// endedClientStream is a grpc.ClientStream that has ended with err
+type endedClientStream struct {
+	grpc.ClientStream
+
+	err error
+}
+
+func (s *endedClientStream) RecvMsg(m interface{}) error {
+	return s.err
+}
+
+func TestOutlierDetectorLongStream(t *testing.T) {
+	d := NewOutlierDetector(OutlierConfig{MinRequests: 5, LatencyFactor: 3, ConsecutiveErrors: 2})
+	d.SetBackends([]string{"a", "b", "c", "watch"})
+
+	for i := 0; i < 5; i++ {
+		for _, addr := range []string{"a", "b", "c", "watch"} {
+			d.Report(addr, nil, 10*time.Millisecond)
+		}
+	}
+
+	// long lived streams of watch end, their lifetime is not a latency
+	for i := 0; i < 5; i++ {
+		s := &outlierClientStream{ClientStream: &endedClientStream{err: io.EOF}, d: d, p: &pick{addr: "watch"}}
+		s.RecvMsg(nil)
+		d.Report("a", nil, 10*time.Millisecond)
+	}
+	if d.Ejected("watch") {
+		t.Fatal("a backend serving long streams should not be ejected")
+	}
+
+	// stream errors still count
+	for i := 0; i < 2; i++ {
+		s := &outlierClientStream{ClientStream: &endedClientStream{err: status.Error(codes.Unavailable, "closing")}, d: d, p: &pick{addr: "watch"}}
+		s.RecvMsg(nil)
+	}
+	if d.Ejected("watch") == false {
+		t.Fatal("a backend whose streams fail should be ejected")
+	}
+}
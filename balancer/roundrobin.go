@@ -0,0 +1,437 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+// addrInfo describes an address of the RoundRobin balancer
+type addrInfo struct {
+	addr      string
+	service   *spec.Service
+	connected bool
+}
+
+// RoundRobin is a grpc.Balancer that selects addresses round-robin
+// It watches the updates of a naming.Resolver like grpc.RoundRobin does.
+// When a Router is given, the addresses are narrowed by the Router before
+// picking, so that version rules and canary splits are applied per RPC.
+// The Metadata of naming.Update is expected to be a *spec.Service.
+type RoundRobin struct {
+	r        naming.Resolver
+	w        naming.Watcher
+	router   *Router
+	outliers *OutlierDetector
+	health   *HealthChecker
+
+	mu     sync.Mutex
+	addrs  []*addrInfo
+	addrCh chan []grpc.Address
+	next   int
+	waitCh chan struct{}
+	done   bool
+}
+
+// ErrorWatcher is a naming.Watcher that reports why it resolves no address
+type ErrorWatcher interface {
+	naming.Watcher
+
+	// Err returns the last resolution error, nil when there is none
+	Err() error
+	// ErrChanged returns a channel that is closed when Err changes, or
+	// when the watcher is closed
+	ErrChanged() <-chan struct{}
+}
+
+// RoundRobinOption configures a RoundRobin
+type RoundRobinOption func(rr *RoundRobin)
+
+// WithOutlierDetector skips the addresses ejected by d
+// The outcomes of calls must be reported to d, see
+// OutlierDetector.UnaryClientInterceptor and StreamClientInterceptor
+func WithOutlierDetector(d *OutlierDetector) RoundRobinOption {
+	return func(rr *RoundRobin) {
+		rr.outliers = d
+	}
+}
+
+// WithHealthChecker skips the addresses that h reports NOT_SERVING
+// h must be started with the balanced connection, see HealthChecker.Start
+func WithHealthChecker(h *HealthChecker) RoundRobinOption {
+	return func(rr *RoundRobin) {
+		rr.health = h
+	}
+}
+
+// NewRoundRobin returns a RoundRobin balancer that watches r
+// router can be nil, then all addresses are used
+func NewRoundRobin(r naming.Resolver, router *Router, opts ...RoundRobinOption) *RoundRobin {
+	rr := &RoundRobin{
+		r:      r,
+		router: router,
+	}
+
+	for _, opt := range opts {
+		opt(rr)
+	}
+
+	return rr
+}
+
+// Start implements grpc.Balancer
+func (rr *RoundRobin) Start(target string, config grpc.BalancerConfig) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if rr.done {
+		return grpc.ErrClientConnClosing
+	}
+
+	w, err := rr.r.Resolve(target)
+	if err != nil {
+		return err
+	}
+
+	rr.w = w
+	rr.addrCh = make(chan []grpc.Address, 1)
+
+	go func() {
+		for {
+			if err := rr.watchAddrUpdates(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if ew, ok := w.(ErrorWatcher); ok {
+		go rr.watchErr(ew)
+	}
+
+	return nil
+}
+
+// watchErr wakes up the blocking Get() callers whenever the resolution
+// error of w changes, so that they fail at once when there is no address
+func (rr *RoundRobin) watchErr(w ErrorWatcher) {
+	var last <-chan struct{}
+	for {
+		// the channel stays the same once the watcher is closed
+		ch := w.ErrChanged()
+		if ch == last {
+			return
+		}
+		<-ch
+		last = ch
+
+		rr.mu.Lock()
+		if rr.done {
+			rr.mu.Unlock()
+			return
+		}
+		if rr.waitCh != nil {
+			close(rr.waitCh)
+			rr.waitCh = nil
+		}
+		rr.mu.Unlock()
+	}
+}
+
+// watchAddrUpdates applies the next updates of the watcher and notifies
+// gRPC of the addresses it should connect to
+func (rr *RoundRobin) watchAddrUpdates() error {
+	updates, err := rr.w.Next()
+	if err != nil {
+		return err
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	// An address deleted and added again in the same updates stays
+	// connected, gRPC does not see it change and does not call Up again
+	deleted := make(map[string]bool)
+
+	for _, update := range updates {
+		service, _ := update.Metadata.(*spec.Service)
+
+		switch update.Op {
+		case naming.Add:
+			if a := rr.find(update.Addr); a != nil {
+				a.service = service
+				continue
+			}
+			rr.addrs = append(rr.addrs, &addrInfo{addr: update.Addr, service: service, connected: deleted[update.Addr]})
+		case naming.Delete:
+			for i, a := range rr.addrs {
+				if a.addr == update.Addr {
+					deleted[a.addr] = a.connected
+					copy(rr.addrs[i:], rr.addrs[i+1:])
+					rr.addrs = rr.addrs[:len(rr.addrs)-1]
+					break
+				}
+			}
+		}
+	}
+
+	if rr.done {
+		return grpc.ErrClientConnClosing
+	}
+
+	// Metadata is not passed to gRPC, so that a metadata change does not
+	// tear down the connection
+	open := make([]grpc.Address, len(rr.addrs))
+	addrs := make([]string, len(rr.addrs))
+	for i, a := range rr.addrs {
+		open[i] = grpc.Address{Addr: a.addr}
+		addrs[i] = a.addr
+	}
+
+	if rr.outliers != nil {
+		rr.outliers.SetBackends(addrs)
+	}
+	if rr.health != nil {
+		rr.health.SetBackends(addrs)
+	}
+
+	select {
+	case <-rr.addrCh:
+	default:
+	}
+	rr.addrCh <- open
+
+	return nil
+}
+
+// find returns the addrInfo of addr
+func (rr *RoundRobin) find(addr string) *addrInfo {
+	for _, a := range rr.addrs {
+		if a.addr == addr {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// Up implements grpc.Balancer
+func (rr *RoundRobin) Up(addr grpc.Address) func(error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	a := rr.find(addr.Addr)
+	if a == nil || a.connected {
+		return nil
+	}
+	a.connected = true
+
+	// Wake up the blocking Get() callers, they will check again
+	if rr.waitCh != nil {
+		close(rr.waitCh)
+		rr.waitCh = nil
+	}
+
+	return func(err error) {
+		rr.down(addr.Addr)
+	}
+}
+
+// down unsets the connected state of addr
+func (rr *RoundRobin) down(addr string) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if a := rr.find(addr); a != nil {
+		a.connected = false
+	}
+}
+
+// available returns the addresses of candidates that are neither ejected
+// nor reported NOT_SERVING
+func (rr *RoundRobin) available(candidates []*addrInfo) []*addrInfo {
+	if rr.outliers == nil && rr.health == nil {
+		return candidates
+	}
+
+	available := make([]*addrInfo, 0, len(candidates))
+	for _, a := range candidates {
+		if rr.outliers != nil && rr.outliers.Ejected(a.addr) {
+			continue
+		}
+		if rr.health != nil && rr.health.Serving(a.addr) == false {
+			continue
+		}
+		available = append(available, a)
+	}
+
+	return available
+}
+
+// route returns the addresses chosen by the router for ctx
+func (rr *RoundRobin) route(ctx context.Context) []*addrInfo {
+	if rr.router == nil || len(rr.addrs) == 0 {
+		return rr.addrs
+	}
+
+	byService := make(map[*spec.Service]*addrInfo, len(rr.addrs))
+	services := make([]*spec.Service, 0, len(rr.addrs))
+	for _, a := range rr.addrs {
+		if a.service == nil {
+			continue
+		}
+		byService[a.service] = a
+		services = append(services, a.service)
+	}
+
+	if len(services) == 0 {
+		return rr.addrs
+	}
+
+	routed := rr.router.Route(ctx, services)
+	candidates := make([]*addrInfo, 0, len(routed))
+	for _, s := range routed {
+		candidates = append(candidates, byService[s])
+	}
+
+	return candidates
+}
+
+// pick returns the next connected address of candidates
+func (rr *RoundRobin) pick(candidates []*addrInfo) (*addrInfo, bool) {
+	for i := 0; i < len(candidates); i++ {
+		a := candidates[(rr.next+i)%len(candidates)]
+		if a.connected {
+			rr.next = (rr.next + i + 1) % len(candidates)
+			return a, true
+		}
+	}
+
+	return nil, false
+}
+
+// Get implements grpc.Balancer
+// It returns the next connected address chosen by the router that is not
+// ejected or NOT_SERVING. Fail-fast RPCs get a not yet connected address
+// instead of blocking.
+func (rr *RoundRobin) Get(ctx context.Context, opts grpc.BalancerGetOptions) (addr grpc.Address, put func(), err error) {
+	for {
+		rr.mu.Lock()
+		if rr.done {
+			rr.mu.Unlock()
+			return addr, nil, grpc.ErrClientConnClosing
+		}
+
+		a, err := rr.get(ctx, opts)
+		if err != nil || a != nil {
+			rr.mu.Unlock()
+			if err != nil {
+				return addr, nil, err
+			}
+			recordPick(ctx, a.addr)
+			return grpc.Address{Addr: a.addr}, nil, nil
+		}
+
+		if rr.waitCh == nil {
+			rr.waitCh = make(chan struct{})
+		}
+		ch := rr.waitCh
+		rr.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return addr, nil, ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// get returns the address for the call of ctx, or nil when the call should
+// wait for an address to be connected, it must be called with rr.mu held
+func (rr *RoundRobin) get(ctx context.Context, opts grpc.BalancerGetOptions) (*addrInfo, error) {
+	// Calls of the health checker go to the address they probe
+	if addr, ok := pinnedAddr(ctx); ok {
+		a := rr.find(addr)
+		if a == nil {
+			return nil, status.Errorf(codes.Unavailable, "address %s is removed", addr)
+		}
+		if a.connected || opts.BlockingWait == false {
+			return a, nil
+		}
+		return nil, nil
+	}
+
+	// Unavailable addresses are only used when no other address is connected
+	candidates := rr.route(ctx)
+	available := rr.available(candidates)
+	a, ok := rr.pick(available)
+	if ok == false && len(available) < len(candidates) {
+		a, ok = rr.pick(candidates)
+	}
+	if ok {
+		return a, nil
+	}
+
+	// Waiting is pointless while the resolver fails to resolve any address
+	if len(candidates) == 0 {
+		if w, ok := rr.w.(ErrorWatcher); ok {
+			if err := w.Err(); err != nil {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+		}
+	}
+
+	if opts.BlockingWait {
+		return nil, nil
+	}
+
+	if len(candidates) == 0 {
+		return nil, status.Errorf(codes.Unavailable, "there is no address available")
+	}
+
+	if len(available) > 0 {
+		candidates = available
+	}
+	a = candidates[rr.next%len(candidates)]
+	rr.next = (rr.next + 1) % len(candidates)
+
+	return a, nil
+}
+
+// Notify implements grpc.Balancer
+func (rr *RoundRobin) Notify() <-chan []grpc.Address {
+	return rr.addrCh
+}
+
+// Close implements grpc.Balancer
+func (rr *RoundRobin) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if rr.done {
+		return fmt.Errorf("balancer: round robin is closed")
+	}
+	rr.done = true
+
+	if rr.w != nil {
+		rr.w.Close()
+	}
+	if rr.health != nil {
+		rr.health.Close()
+	}
+	if rr.waitCh != nil {
+		close(rr.waitCh)
+		rr.waitCh = nil
+	}
+	if rr.addrCh != nil {
+		close(rr.addrCh)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package balancer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+// testWatcher is a naming.Resolver and naming.Watcher whose updates are
+// sent by the test
+type testWatcher struct {
+	updates chan []*naming.Update
+	closed  chan struct{}
+}
+
+func newTestWatcher() *testWatcher {
+	return &testWatcher{
+		updates: make(chan []*naming.Update),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (w *testWatcher) Resolve(target string) (naming.Watcher, error) {
+	return w, nil
+}
+
+func (w *testWatcher) Next() ([]*naming.Update, error) {
+	select {
+	case updates := <-w.updates:
+		return updates, nil
+	case <-w.closed:
+		return nil, errors.New("watcher is closed")
+	}
+}
+
+func (w *testWatcher) Close() {
+	close(w.closed)
+}
+
+// send applies updates to rr and waits for the addresses it notifies
+func (w *testWatcher) send(t *testing.T, rr *RoundRobin, updates ...*naming.Update) {
+	w.updates <- updates
+
+	select {
+	case <-rr.Notify():
+	case <-time.After(time.Second):
+		t.Fatal("addresses should be notified")
+	}
+}
+
+func TestRoundRobinRetag(t *testing.T) {
+	stable := &spec.Service{ID: "a", Tags: []string{"v1"}}
+	canary := &spec.Service{ID: "a", Tags: []string{"v1", "canary"}}
+
+	w := newTestWatcher()
+	rr := NewRoundRobin(w, NewRouter(&Rules{Rules: []Rule{{Target: Target{Tags: []string{"canary"}}}}}))
+	if err := rr.Start("a", grpc.BalancerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	w.send(t, rr, &naming.Update{Op: naming.Add, Addr: "a:1", Metadata: stable})
+	rr.Up(grpc.Address{Addr: "a:1"})
+
+	tests := []struct {
+		name    string
+		updates []*naming.Update
+	}{
+		{"add", []*naming.Update{{Op: naming.Add, Addr: "a:1", Metadata: canary}}},
+		{"delete and add", []*naming.Update{
+			{Op: naming.Delete, Addr: "a:1", Metadata: canary},
+			{Op: naming.Add, Addr: "a:1", Metadata: canary},
+		}},
+	}
+
+	for _, test := range tests {
+		w.send(t, rr, test.updates...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		addr, _, err := rr.Get(ctx, grpc.BalancerGetOptions{BlockingWait: true})
+		cancel()
+		if err != nil || addr.Addr != "a:1" {
+			t.Errorf("%s: retagged address should be picked, got %v, %v", test.name, addr, err)
+		}
+	}
+}
+
+// testErrorWatcher is a testWatcher that reports resolution errors
+type testErrorWatcher struct {
+	*testWatcher
+
+	mu         sync.Mutex
+	err        error
+	errChanged chan struct{}
+}
+
+func (w *testErrorWatcher) Resolve(target string) (naming.Watcher, error) {
+	return w, nil
+}
+
+func (w *testErrorWatcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+func (w *testErrorWatcher) ErrChanged() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.errChanged
+}
+
+func (w *testErrorWatcher) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.err = err
+	close(w.errChanged)
+	w.errChanged = make(chan struct{})
+}
+
+func TestRoundRobinWaitingGetFailsOnResolverError(t *testing.T) {
+	w := &testErrorWatcher{testWatcher: newTestWatcher(), errChanged: make(chan struct{})}
+	rr := NewRoundRobin(w, nil)
+	if err := rr.Start("a", grpc.BalancerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _, err := rr.Get(ctx, grpc.BalancerGetOptions{BlockingWait: true})
+		errc <- err
+	}()
+
+	// wait for Get to block
+	for {
+		rr.mu.Lock()
+		waiting := rr.waitCh != nil
+		rr.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w.setErr(errors.New("registry error"))
+
+	select {
+	case err := <-errc:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("waiting Get failed with %v, want Unavailable", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting Get was not woken up by the resolver error")
+	}
+}
@@ -0,0 +1,213 @@
+package balancer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/servicekit/servicekit-go/spec"
+	"github.com/servicekit/servicekit-go/version"
+)
+
+// Target describes a set of instances by version pattern and tags
+// An instance belongs to a Target when its version matches Version
+// (see version.Match) and it carries every tag in Tags
+type Target struct {
+	Version string   `json:"version,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// match returns true when the service belongs to the target
+func (t *Target) match(s *spec.Service) bool {
+	if version.Match(t.Version, s.Version) == false {
+		return false
+	}
+
+	for _, tag := range t.Tags {
+		if hasTag(s.Tags, tag) == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Split is a Target that receives Weight parts of the traffic of a Rule
+type Split struct {
+	Target
+	Weight int `json:"weight"`
+}
+
+// Rule describes where the requests go
+// When Header is set, the rule only applies to requests whose outgoing
+// metadata carries Header with Value. The requests are sent to Target, or
+// split across Splits by weight when Splits is not empty.
+type Rule struct {
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+
+	Target
+	Splits []Split `json:"splits,omitempty"`
+}
+
+// Rules is an ordered list of Rule, the first rule that applies wins
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ParseRules returns Rules parsed from JSON, e.g.
+//     {"rules": [
+//         {"header": "x-canary", "value": "true", "tags": ["canary"]},
+//         {"splits": [{"version": "v1.4.x", "weight": 95}, {"version": "v1.5.0", "weight": 5}]}
+//     ]}
+func ParseRules(data []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// LoadRules returns Rules read from a JSON file
+func LoadRules(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRules(data)
+}
+
+// Router selects instances by Rules
+// Rules can be swapped at any time, in-flight selections keep using the
+// rules they started with
+type Router struct {
+	rules atomic.Value
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewRouter returns a Router with rules
+func NewRouter(rules *Rules) *Router {
+	r := &Router{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	r.SetRules(rules)
+
+	return r
+}
+
+// SetRules replaces the rules of Router
+func (r *Router) SetRules(rules *Rules) {
+	if rules == nil {
+		rules = &Rules{}
+	}
+
+	r.rules.Store(rules)
+}
+
+// GetRules returns the rules currently used by Router
+func (r *Router) GetRules() *Rules {
+	return r.rules.Load().(*Rules)
+}
+
+// Reload replaces the rules of Router with rules read from a JSON file
+// The current rules are kept when the file is invalid
+func (r *Router) Reload(path string) error {
+	rules, err := LoadRules(path)
+	if err != nil {
+		return err
+	}
+
+	r.SetRules(rules)
+
+	return nil
+}
+
+// Route returns the instances that the request carried by ctx should go to
+// Rules that select no instance are skipped. When no rule applies, all
+// instances are returned.
+func (r *Router) Route(ctx context.Context, services []*spec.Service) []*spec.Service {
+	md, _ := metadata.FromOutgoingContext(ctx)
+
+	for _, rule := range r.GetRules().Rules {
+		if rule.Header != "" {
+			values := md.Get(rule.Header)
+			if len(values) == 0 || values[0] != rule.Value {
+				continue
+			}
+		}
+
+		target := rule.Target
+		if len(rule.Splits) > 0 {
+			target = r.split(rule.Splits)
+		}
+
+		selected := selectServices(services, &target)
+		if len(selected) > 0 {
+			return selected
+		}
+	}
+
+	return services
+}
+
+// split returns a Target chosen randomly by weight
+func (r *Router) split(splits []Split) Target {
+	total := 0
+	for _, s := range splits {
+		if s.Weight > 0 {
+			total += s.Weight
+		}
+	}
+
+	if total == 0 {
+		return splits[0].Target
+	}
+
+	r.mu.Lock()
+	n := r.rand.Intn(total)
+	r.mu.Unlock()
+
+	for _, s := range splits {
+		if s.Weight <= 0 {
+			continue
+		}
+		if n < s.Weight {
+			return s.Target
+		}
+		n -= s.Weight
+	}
+
+	return splits[len(splits)-1].Target
+}
+
+// selectServices returns the services that belong to target
+func selectServices(services []*spec.Service, target *Target) []*spec.Service {
+	var selected []*spec.Service
+	for _, s := range services {
+		if target.match(s) {
+			selected = append(selected, s)
+		}
+	}
+
+	return selected
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,42 @@
+package balancer
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+func TestRouterRoute(t *testing.T) {
+	stable := &spec.Service{ID: "stable", Version: "v1.4.2", Tags: []string{"v1.4.2"}}
+	canary := &spec.Service{ID: "canary", Version: "v1.5.0", Tags: []string{"v1.5.0", "canary"}}
+	services := []*spec.Service{stable, canary}
+
+	rules, err := ParseRules([]byte(`{"rules": [
+		{"header": "x-canary", "value": "true", "tags": ["canary"]},
+		{"splits": [{"version": "v1.4.x", "weight": 100}, {"version": "v1.5.0", "weight": 0}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter(rules)
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-canary", "true"))
+	if routed := r.Route(ctx, services); len(routed) != 1 || routed[0] != canary {
+		t.Errorf("canary header routed to %v", routed)
+	}
+
+	for i := 0; i < 10; i++ {
+		if routed := r.Route(context.Background(), services); len(routed) != 1 || routed[0] != stable {
+			t.Errorf("split routed to %v", routed)
+		}
+	}
+
+	r.SetRules(&Rules{Rules: []Rule{{Target: Target{Version: "v2.x"}}}})
+	if routed := r.Route(context.Background(), services); len(routed) != 2 {
+		t.Errorf("unmatched rules routed to %v", routed)
+	}
+}
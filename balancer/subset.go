@@ -0,0 +1,61 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// Subset returns a stable subset of keys of the given size for a client
+// It uses rendezvous (highest random weight) hashing: every key gets a
+// weight from hashing it together with clientID, and the keys with the
+// highest weights are chosen. The same client always gets the same subset,
+// different clients spread evenly across keys, and a membership change only
+// replaces the keys that joined or left.
+// When size is not positive or not less than len(keys), keys is returned.
+func Subset(clientID string, keys []string, size int) []string {
+	if size <= 0 || size >= len(keys) {
+		return keys
+	}
+
+	type weighted struct {
+		key    string
+		weight uint64
+	}
+
+	ws := make([]weighted, len(keys))
+	for i, key := range keys {
+		ws[i] = weighted{key: key, weight: rendezvousWeight(clientID, key)}
+	}
+
+	sort.Slice(ws, func(i, j int) bool {
+		if ws[i].weight == ws[j].weight {
+			return ws[i].key < ws[j].key
+		}
+		return ws[i].weight > ws[j].weight
+	})
+
+	subset := make([]string, size)
+	for i := range subset {
+		subset[i] = ws[i].key
+	}
+
+	return subset
+}
+
+// rendezvousWeight returns the weight of key for clientID
+func rendezvousWeight(clientID, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(clientID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	// fnv does not avalanche well on similar inputs, mix the bits
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
@@ -0,0 +1,75 @@
+package balancer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSubsetStable(t *testing.T) {
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.0.0.%d:8080", i)
+	}
+
+	subset := Subset("client-1", keys, 5)
+	if len(subset) != 5 {
+		t.Fatalf("subset of %d keys, want 5", len(subset))
+	}
+
+	// the order of keys does not matter
+	reversed := make([]string, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	if again := Subset("client-1", reversed, 5); fmt.Sprint(again) != fmt.Sprint(subset) {
+		t.Errorf("subset changed from %v to %v", subset, again)
+	}
+
+	if all := Subset("client-1", keys, 20); len(all) != 20 {
+		t.Errorf("size >= len(keys) returned %d keys", len(all))
+	}
+}
+
+func TestSubsetMembershipChange(t *testing.T) {
+	const (
+		backends = 20
+		size     = 5
+		clients  = 1000
+	)
+
+	keys := make([]string, backends)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.0.0.%d:8080", i)
+	}
+	added := append(append([]string{}, keys...), "10.0.0.100:8080")
+	removed := keys[1:]
+
+	moved := func(to []string) int {
+		n := 0
+		for c := 0; c < clients; c++ {
+			id := fmt.Sprintf("client-%d", c)
+			before := make(map[string]bool)
+			for _, key := range Subset(id, keys, size) {
+				before[key] = true
+			}
+			for _, key := range Subset(id, to, size) {
+				if before[key] == false {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	// about size/backends of the clients get the new backend, and the
+	// clients of the removed backend replace it, one key each
+	for name, to := range map[string][]string{"add": added, "remove": removed} {
+		n := moved(to)
+		if expected := clients * size / backends; n > 2*expected {
+			t.Errorf("%s: %d keys moved, want about %d", name, n, expected)
+		}
+		if n == 0 {
+			t.Errorf("%s: no key moved", name)
+		}
+	}
+}
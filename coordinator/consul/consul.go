@@ -7,6 +7,8 @@ import (
 	"github.com/hashicorp/consul/api"
 	"golang.org/x/net/context"
 
+	"github.com/servicekit/servicekit-go/coordinator"
+	"github.com/servicekit/servicekit-go/filter"
 	"github.com/servicekit/servicekit-go/logger"
 	"github.com/servicekit/servicekit-go/spec"
 	"github.com/servicekit/servicekit-go/version"
@@ -54,6 +56,23 @@ func NewConsul(addr, scheme, token string, log *logger.Logger) (*Consul, error)
 
 // GetServices returns all service by context, name and tag
 func (c *Consul) GetServices(ctx context.Context, name string, tag string) ([]*spec.Service, interface{}, error) {
+	return c.getServices(ctx, name, tag, nil)
+}
+
+// GetServicesWithFilter returns all service by context, name, tag and filter
+// The filter is translated into the Consul filter query parameter, the
+// services are checked again by the filter in case the agent ignores it
+func (c *Consul) GetServicesWithFilter(ctx context.Context, name string, tag string, f *filter.Filter) ([]*spec.Service, interface{}, error) {
+	services, meta, err := c.getServices(ctx, name, tag, f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f.Select(services), meta, nil
+}
+
+// getServices returns all service by context, name, tag and filter
+func (c *Consul) getServices(ctx context.Context, name string, tag string, f *filter.Filter) ([]*spec.Service, interface{}, error) {
 	var passingOnly bool
 	var queryOptions *api.QueryOptions
 
@@ -69,6 +88,15 @@ func (c *Consul) GetServices(ctx context.Context, name string, tag string) ([]*s
 		queryOptions = v
 	}
 
+	if f != nil {
+		q := &api.QueryOptions{}
+		if queryOptions != nil {
+			*q = *queryOptions
+		}
+		q.Filter = f.Consul()
+		queryOptions = q
+	}
+
 	serviceEntries, meta, err := c.c.Health().Service(name, tag, passingOnly, queryOptions)
 	if err != nil {
 		return nil, nil, err
@@ -85,6 +113,7 @@ func (c *Consul) GetServices(ctx context.Context, name string, tag string) ([]*s
 			ID:          serviceEntry.Service.ID,
 			Service:     serviceEntry.Service.Service,
 			Tags:        serviceEntry.Service.Tags,
+			Meta:        serviceEntry.Service.Meta,
 			Version:     version.GetVersion(serviceEntry.Service.Tags),
 			Address:     serviceEntry.Service.Address,
 			Port:        serviceEntry.Service.Port,
@@ -101,6 +130,8 @@ func (c *Consul) GetServices(ctx context.Context, name string, tag string) ([]*s
 }
 
 // Register register a new service
+// Its TTL check is updated as passing until ctx is done, or with the status
+// of the CheckFunc of ctx, see coordinator.WithCheckFunc.
 func (c *Consul) Register(ctx context.Context, serv *spec.Service, ttl time.Duration) error {
 	enableTLS, ok := ctx.Value("enabletls").(bool)
 	if ok != true {
@@ -113,6 +144,7 @@ func (c *Consul) Register(ctx context.Context, serv *spec.Service, ttl time.Dura
 		Address: serv.Address,
 		Port:    serv.Port,
 		Tags:    serv.Tags,
+		Meta:    serv.Meta,
 		Check: &api.AgentServiceCheck{
 			TTL:           ttl.String(),
 			TLSSkipVerify: enableTLS,
@@ -123,6 +155,8 @@ func (c *Consul) Register(ctx context.Context, serv *spec.Service, ttl time.Dura
 		return err
 	}
 
+	check := coordinator.CheckFuncFromContext(ctx)
+
 	go func(ctx context.Context) {
 		c.log.Infof("consul: service: %s update ttl started", serv.ID)
 		for {
@@ -131,8 +165,12 @@ func (c *Consul) Register(ctx context.Context, serv *spec.Service, ttl time.Dura
 				c.log.Infof("consul: service: %s update ttl stopped", serv.ID)
 				return
 			default:
-				c.log.Debugf("consul: service: %s updated ttl ", serv.ID)
-				c.c.Agent().UpdateTTL(fmt.Sprintf("service:%s", serv.ID), "", api.HealthPassing)
+				status := api.HealthPassing
+				if check != nil {
+					status = check()
+				}
+				c.log.Debugf("consul: service: %s updated ttl, %s", serv.ID, status)
+				c.c.Agent().UpdateTTL(fmt.Sprintf("service:%s", serv.ID), "", status)
 				time.Sleep(ttl/2 - 1)
 			}
 		}
@@ -145,3 +183,52 @@ func (c *Consul) Register(ctx context.Context, serv *spec.Service, ttl time.Dura
 func (c *Consul) Deregister(ctx context.Context, serviceID string) error {
 	return c.c.Agent().ServiceDeregister(serviceID)
 }
+
+// GetKV returns the value of key and its modify index
+func (c *Consul) GetKV(ctx context.Context, key string) ([]byte, uint64, error) {
+	pair, _, err := c.c.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	if pair == nil {
+		return nil, 0, nil
+	}
+
+	return pair.Value, pair.ModifyIndex, nil
+}
+
+// PutKV sets the value of key
+func (c *Consul) PutKV(ctx context.Context, key string, value []byte) error {
+	_, err := c.c.KV().Put(&api.KVPair{Key: key, Value: value}, (&api.WriteOptions{}).WithContext(ctx))
+
+	return err
+}
+
+// CompareAndSwapKV sets the value of key when its modify index is index
+func (c *Consul) CompareAndSwapKV(ctx context.Context, key string, value []byte, index uint64) (bool, error) {
+	ok, _, err := c.c.KV().CAS(&api.KVPair{Key: key, Value: value, ModifyIndex: index}, (&api.WriteOptions{}).WithContext(ctx))
+
+	return ok, err
+}
+
+// ListKV returns the keys that start with prefix
+func (c *Consul) ListKV(ctx context.Context, prefix string) ([]*coordinator.KVPair, error) {
+	pairs, _, err := c.c.KV().List(prefix, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make([]*coordinator.KVPair, 0, len(pairs))
+	for _, pair := range pairs {
+		kvs = append(kvs, &coordinator.KVPair{Key: pair.Key, Value: pair.Value, ModifyIndex: pair.ModifyIndex})
+	}
+
+	return kvs, nil
+}
+
+// CompareAndDeleteKV deletes key when its modify index is index
+func (c *Consul) CompareAndDeleteKV(ctx context.Context, key string, index uint64) (bool, error) {
+	ok, _, err := c.c.KV().DeleteCAS(&api.KVPair{Key: key, ModifyIndex: index}, (&api.WriteOptions{}).WithContext(ctx))
+
+	return ok, err
+}
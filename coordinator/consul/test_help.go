@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/servicekit/servicekit-go/coordinator"
 	"github.com/servicekit/servicekit-go/spec"
 )
 
@@ -16,6 +20,12 @@ type TestConsul struct {
 	GetServicesError    error
 	RegisterError       error
 	DeregisterError     error
+	KVError             error
+
+	mu    sync.Mutex
+	kv    map[string]*api.KVPair
+	index uint64
+	check coordinator.CheckFunc
 }
 
 // GetServices returns some service which services do we want to return
@@ -25,10 +35,125 @@ func (t *TestConsul) GetServices(ctx context.Context, name string, tag string) (
 
 // Register register a service which service do we want to register
 func (t *TestConsul) Register(ctx context.Context, serv *spec.Service, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.check = coordinator.CheckFuncFromContext(ctx)
+
 	return t.RegisterError
 }
 
+// CheckStatus returns the check status of the last registered service
+func (t *TestConsul) CheckStatus() string {
+	t.mu.Lock()
+	check := t.check
+	t.mu.Unlock()
+
+	if check == nil {
+		return coordinator.CheckPassing
+	}
+
+	return check()
+}
+
 // Deregister deregister a service which service do we want to deregister
 func (t *TestConsul) Deregister(ctx context.Context, serviceID string) error {
 	return t.DeregisterError
 }
+
+// GetKV returns the value of key from memory
+func (t *TestConsul) GetKV(ctx context.Context, key string) ([]byte, uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.KVError != nil {
+		return nil, 0, t.KVError
+	}
+	pair, ok := t.kv[key]
+	if ok == false {
+		return nil, 0, nil
+	}
+
+	return pair.Value, pair.ModifyIndex, nil
+}
+
+// PutKV sets the value of key in memory
+func (t *TestConsul) PutKV(ctx context.Context, key string, value []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.KVError != nil {
+		return t.KVError
+	}
+	t.put(key, value)
+
+	return nil
+}
+
+// CompareAndSwapKV sets the value of key in memory when its modify index is
+// index
+func (t *TestConsul) CompareAndSwapKV(ctx context.Context, key string, value []byte, index uint64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.KVError != nil {
+		return false, t.KVError
+	}
+	var current uint64
+	if pair, ok := t.kv[key]; ok {
+		current = pair.ModifyIndex
+	}
+	if current != index {
+		return false, nil
+	}
+	t.put(key, value)
+
+	return true, nil
+}
+
+// ListKV returns the keys of memory that start with prefix
+func (t *TestConsul) ListKV(ctx context.Context, prefix string) ([]*coordinator.KVPair, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.KVError != nil {
+		return nil, t.KVError
+	}
+	var pairs []*coordinator.KVPair
+	for key, pair := range t.kv {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, &coordinator.KVPair{Key: key, Value: pair.Value, ModifyIndex: pair.ModifyIndex})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	return pairs, nil
+}
+
+// CompareAndDeleteKV deletes key from memory when its modify index is index
+func (t *TestConsul) CompareAndDeleteKV(ctx context.Context, key string, index uint64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.KVError != nil {
+		return false, t.KVError
+	}
+	pair, ok := t.kv[key]
+	if ok == false {
+		return true, nil
+	}
+	if pair.ModifyIndex != index {
+		return false, nil
+	}
+	delete(t.kv, key)
+
+	return true, nil
+}
+
+func (t *TestConsul) put(key string, value []byte) {
+	if t.kv == nil {
+		t.kv = make(map[string]*api.KVPair)
+	}
+	t.index++
+	t.kv[key] = &api.KVPair{Key: key, Value: value, ModifyIndex: t.index}
+}
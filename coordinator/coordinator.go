@@ -5,6 +5,7 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/servicekit/servicekit-go/filter"
 	"github.com/servicekit/servicekit-go/spec"
 )
 
@@ -17,3 +18,81 @@ type Coordinator interface {
 	Register(ctx context.Context, serv *spec.Service, ttl time.Duration) error
 	Deregister(ctx context.Context, serviceID string) error
 }
+
+// The check statuses of a registered service
+const (
+	CheckPassing  = "passing"
+	CheckWarning  = "warning"
+	CheckCritical = "critical"
+)
+
+// CheckFunc returns the check status of a registered service
+type CheckFunc func() string
+
+type checkFuncKey struct{}
+
+// WithCheckFunc returns a context whose Register reports the status of f,
+// instead of CheckPassing, on every check update, so that the registry
+// routes away from a service that is busy or unavailable
+func WithCheckFunc(ctx context.Context, f CheckFunc) context.Context {
+	return context.WithValue(ctx, checkFuncKey{}, f)
+}
+
+// CheckFuncFromContext returns the CheckFunc of ctx, nil when none
+func CheckFuncFromContext(ctx context.Context) CheckFunc {
+	f, _ := ctx.Value(checkFuncKey{}).(CheckFunc)
+
+	return f
+}
+
+// FilterCoordinator is a Coordinator that can select services by a filter
+// on the registry side
+type FilterCoordinator interface {
+	GetServicesWithFilter(ctx context.Context, name string, tag string, f *filter.Filter) ([]*spec.Service, interface{}, error)
+}
+
+// KVPair is a key of a KVCoordinator with its value and modify index
+type KVPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// KVCoordinator holds a key/value store shared by the replicas of services
+// It is implemented by the coordinators that are also a Coordinator, e.g.
+// Consul.
+type KVCoordinator interface {
+	// GetKV returns the value of key and its modify index, a missing key
+	// returns nil and 0
+	GetKV(ctx context.Context, key string) ([]byte, uint64, error)
+	// PutKV sets the value of key
+	PutKV(ctx context.Context, key string, value []byte) error
+	// CompareAndSwapKV sets the value of key when its modify index is still
+	// index, an index of 0 only creates a missing key. It returns false when
+	// the key was modified in between.
+	CompareAndSwapKV(ctx context.Context, key string, value []byte, index uint64) (bool, error)
+	// ListKV returns the keys that start with prefix
+	ListKV(ctx context.Context, prefix string) ([]*KVPair, error)
+	// CompareAndDeleteKV deletes key when its modify index is still index.
+	// It returns false when the key was modified in between.
+	CompareAndDeleteKV(ctx context.Context, key string, index uint64) (bool, error)
+}
+
+// GetServices returns the services of c selected by name, tag and f
+// When c is not a FilterCoordinator, f is evaluated on the client side
+func GetServices(ctx context.Context, c Coordinator, name string, tag string, f *filter.Filter) ([]*spec.Service, interface{}, error) {
+	if f == nil {
+		return c.GetServices(ctx, name, tag)
+	}
+
+	if fc, ok := c.(FilterCoordinator); ok {
+		return fc.GetServicesWithFilter(ctx, name, tag, f)
+	}
+
+	services, meta, err := c.GetServices(ctx, name, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f.Select(services), meta, nil
+}
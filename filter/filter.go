@@ -0,0 +1,265 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+// Filter is a parsed filter expression for selecting service instances
+// An expression compares fields of an instance with values, e.g.
+//     tag in [grpc, v2] and meta.zone == "a" and not tag == "canary"
+// Fields are:
+//     tag          any tag of the instance
+//     meta.<key>   the value of a metadata key
+//     id, service, address, node, datacenter
+// Operators are ==, !=, in [..], not in [..], and, or, not and parentheses.
+// Values are bare words or double quoted strings.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse returns a Filter parsed from expr
+// An empty expr returns a nil Filter that matches every instance
+func Parse(expr string) (*Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	p := &parser{lexer: newLexer(expr)}
+	root, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("filter: %s: %v", expr, err)
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustParse is like Parse but panics if expr cannot be parsed
+func MustParse(expr string) *Filter {
+	f, err := Parse(expr)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// String returns the expression of Filter
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.expr
+}
+
+// Match returns true when the service is selected by Filter
+func (f *Filter) Match(s *spec.Service) bool {
+	if f == nil {
+		return true
+	}
+
+	return f.root.match(s)
+}
+
+// Select returns the services selected by Filter
+func (f *Filter) Select(services []*spec.Service) []*spec.Service {
+	if f == nil {
+		return services
+	}
+
+	selected := make([]*spec.Service, 0, len(services))
+	for _, s := range services {
+		if f.root.match(s) {
+			selected = append(selected, s)
+		}
+	}
+
+	return selected
+}
+
+// Consul returns Filter translated into a Consul filter expression
+// It can be used as the Filter of the health service endpoint
+// See: https://www.consul.io/api/features/filtering.html
+func (f *Filter) Consul() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.root.consul()
+}
+
+// node is a node of a filter expression
+type node interface {
+	match(s *spec.Service) bool
+	consul() string
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) match(s *spec.Service) bool {
+	return n.left.match(s) && n.right.match(s)
+}
+
+func (n *andNode) consul() string {
+	return fmt.Sprintf("(%s and %s)", n.left.consul(), n.right.consul())
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) match(s *spec.Service) bool {
+	return n.left.match(s) || n.right.match(s)
+}
+
+func (n *orNode) consul() string {
+	return fmt.Sprintf("(%s or %s)", n.left.consul(), n.right.consul())
+}
+
+type notNode struct {
+	n node
+}
+
+func (n *notNode) match(s *spec.Service) bool {
+	return !n.n.match(s)
+}
+
+func (n *notNode) consul() string {
+	return fmt.Sprintf("not %s", n.n.consul())
+}
+
+const (
+	opEqual    = "=="
+	opNotEqual = "!="
+	opIn       = "in"
+	opNotIn    = "not in"
+)
+
+// compareNode compares a field with one (==, !=) or more (in, not in) values
+type compareNode struct {
+	field  field
+	op     string
+	values []string
+}
+
+func (n *compareNode) match(s *spec.Service) bool {
+	found := false
+	for _, v := range n.field.values(s) {
+		for _, want := range n.values {
+			if v == want {
+				found = true
+			}
+		}
+	}
+
+	if n.op == opNotEqual || n.op == opNotIn {
+		return !found
+	}
+
+	return found
+}
+
+func (n *compareNode) consul() string {
+	negative := n.op == opNotEqual || n.op == opNotIn
+
+	terms := make([]string, 0, len(n.values))
+	for _, v := range n.values {
+		terms = append(terms, n.field.consul(strconv.Quote(v), negative))
+	}
+
+	if len(terms) == 1 {
+		return terms[0]
+	}
+
+	join := " or "
+	if negative {
+		join = " and "
+	}
+
+	return "(" + strings.Join(terms, join) + ")"
+}
+
+// field is an attribute of a service that can be compared
+type field struct {
+	name string
+	key  string
+}
+
+// fields maps a field name to its Consul selector
+var fields = map[string]string{
+	"tag":        "Service.Tags",
+	"id":         "Service.ID",
+	"service":    "Service.Service",
+	"address":    "Service.Address",
+	"node":       "Node.Node",
+	"datacenter": "Node.Datacenter",
+	"meta":       "Service.Meta",
+}
+
+// newField returns the field named name, e.g. tag or meta.zone
+func newField(name string) (field, error) {
+	if strings.HasPrefix(name, "meta.") && len(name) > len("meta.") {
+		return field{name: "meta", key: name[len("meta."):]}, nil
+	}
+
+	if _, ok := fields[name]; ok == false || name == "meta" {
+		return field{}, fmt.Errorf("unknown field %q", name)
+	}
+
+	return field{name: name}, nil
+}
+
+// values returns the values of the field in a service
+func (f field) values(s *spec.Service) []string {
+	switch f.name {
+	case "tag":
+		return s.Tags
+	case "id":
+		return []string{s.ID}
+	case "service":
+		return []string{s.Service}
+	case "address":
+		return []string{s.Address}
+	case "node":
+		return []string{s.Node}
+	case "datacenter":
+		return []string{s.Datacenter}
+	case "meta":
+		if v, ok := s.Meta[f.key]; ok {
+			return []string{v}
+		}
+	}
+
+	return nil
+}
+
+// consul returns a Consul expression comparing the field with a quoted value
+func (f field) consul(value string, negative bool) string {
+	selector := fields[f.name]
+
+	if f.name == "tag" {
+		if negative {
+			return fmt.Sprintf("%s not in %s", value, selector)
+		}
+		return fmt.Sprintf("%s in %s", value, selector)
+	}
+
+	if f.name == "meta" {
+		// the key is quoted, so that keys like canary-weight are not parsed
+		// as an expression
+		selector = selector + "[" + strconv.Quote(f.key) + "]"
+	}
+
+	if negative {
+		return fmt.Sprintf("%s != %s", selector, value)
+	}
+
+	return fmt.Sprintf("%s == %s", selector, value)
+}
@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+func TestFilterMatch(t *testing.T) {
+	f, err := Parse(`tag in [grpc, v2] and meta.zone == "a" and not tag == "canary"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		service *spec.Service
+		match   bool
+	}{
+		{&spec.Service{Tags: []string{"grpc"}, Meta: map[string]string{"zone": "a"}}, true},
+		{&spec.Service{Tags: []string{"v2", "canary"}, Meta: map[string]string{"zone": "a"}}, false},
+		{&spec.Service{Tags: []string{"grpc"}, Meta: map[string]string{"zone": "b"}}, false},
+		{&spec.Service{Tags: []string{"http"}, Meta: map[string]string{"zone": "a"}}, false},
+	}
+
+	for i, c := range cases {
+		if m := f.Match(c.service); m != c.match {
+			t.Errorf("case %d: match = %v, want %v", i, m, c.match)
+		}
+	}
+}
+
+func TestFilterConsul(t *testing.T) {
+	cases := map[string]string{
+		`tag == grpc`:                      `"grpc" in Service.Tags`,
+		`tag not in [a, b]`:                `("a" not in Service.Tags and "b" not in Service.Tags)`,
+		`meta.zone == "a" or node != n1`:   `(Service.Meta["zone"] == "a" or Node.Node != "n1")`,
+		`meta.canary-weight != 0`:          `Service.Meta["canary-weight"] != "0"`,
+		`not (tag == canary and id == x1)`: `not ("canary" in Service.Tags and Service.ID == "x1")`,
+	}
+
+	for expr, want := range cases {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Consul(); got != want {
+			t.Errorf("%s: Consul() = %s, want %s", expr, got, want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, expr := range []string{`tag ==`, `color == red`, `tag in grpc`, `(tag == a`, `tag == "a`} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
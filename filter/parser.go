@@ -0,0 +1,327 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenEqual
+	tokenNotEqual
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// lexer splits an expression into tokens
+type lexer struct {
+	input string
+	pos   int
+}
+
+func newLexer(input string) *lexer {
+	return &lexer{input: input}
+}
+
+// isWordRune returns true when r can be part of a bare word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-.:/", r)
+}
+
+// next returns the next token
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+
+	switch c := l.input[l.pos]; {
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLParen, value: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRParen, value: ")", pos: start}, nil
+	case c == '[':
+		l.pos++
+		return token{kind: tokenLBracket, value: "[", pos: start}, nil
+	case c == ']':
+		l.pos++
+		return token{kind: tokenRBracket, value: "]", pos: start}, nil
+	case c == ',':
+		l.pos++
+		return token{kind: tokenComma, value: ",", pos: start}, nil
+	case strings.HasPrefix(l.input[l.pos:], "=="):
+		l.pos += 2
+		return token{kind: tokenEqual, value: "==", pos: start}, nil
+	case strings.HasPrefix(l.input[l.pos:], "!="):
+		l.pos += 2
+		return token{kind: tokenNotEqual, value: "!=", pos: start}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.input) && l.input[l.pos] != '"' {
+			if l.input[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.input) {
+			return token{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.input[start:l.pos])
+		if err != nil {
+			return token{}, fmt.Errorf("invalid string at %d: %v", start, err)
+		}
+		return token{kind: tokenString, value: s, pos: start}, nil
+	}
+
+	for _, r := range l.input[l.pos:] {
+		if isWordRune(r) == false {
+			break
+		}
+		l.pos += len(string(r))
+	}
+
+	if l.pos == start {
+		return token{}, fmt.Errorf("unexpected %q at %d", l.input[start], start)
+	}
+
+	return token{kind: tokenWord, value: l.input[start:l.pos], pos: start}, nil
+}
+
+// parser is a recursive descent parser of
+//     expr       = and { "or" and }
+//     and        = unary { "and" unary }
+//     unary      = "not" unary | "(" expr ")" | comparison
+//     comparison = field ( "==" value | "!=" value | [ "not" ] "in" list )
+//     list       = "[" value { "," value } "]"
+type parser struct {
+	lexer *lexer
+	tok   token
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+
+	p.tok = tok
+
+	return nil
+}
+
+// keyword returns true when the current token is the keyword kw
+func (p *parser) keyword(kw string) bool {
+	return p.tok.kind == tokenWord && p.tok.value == kw
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+
+	return fmt.Errorf("unexpected %q at %d", p.tok.value, p.tok.pos)
+}
+
+func (p *parser) parse() (node, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+
+	return n, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.keyword("not") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n: n}, nil
+	}
+
+	if p.tok.kind == tokenLParen {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenRParen {
+			return nil, p.unexpected()
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	if p.tok.kind != tokenWord {
+		return nil, p.unexpected()
+	}
+
+	f, err := newField(p.tok.value)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	n := &compareNode{field: f}
+
+	switch {
+	case p.tok.kind == tokenEqual, p.tok.kind == tokenNotEqual:
+		n.op = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		n.values = []string{v}
+		return n, nil
+	case p.keyword("not"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.keyword("in") == false {
+			return nil, p.unexpected()
+		}
+		n.op = opNotIn
+	case p.keyword("in"):
+		n.op = opIn
+	default:
+		return nil, p.unexpected()
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	n.values, err = p.parseList()
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (p *parser) parseValue() (string, error) {
+	if p.tok.kind != tokenWord && p.tok.kind != tokenString {
+		return "", p.unexpected()
+	}
+
+	v := p.tok.value
+
+	return v, p.advance()
+}
+
+func (p *parser) parseList() ([]string, error) {
+	if p.tok.kind != tokenLBracket {
+		return nil, p.unexpected()
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		if p.tok.kind == tokenRBracket {
+			return values, p.advance()
+		}
+		if p.tok.kind != tokenComma {
+			return nil, p.unexpected()
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+}
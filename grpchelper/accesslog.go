@@ -0,0 +1,79 @@
+package grpchelper
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+// WithSampleRate logs rate (0 to 1) of the calls that succeed in time
+// Calls that fail or are slower than the slow threshold are always logged.
+// By default every call is logged.
+func WithSampleRate(rate float64) ServerInterceptorOption {
+	return func(o *serverInterceptorOptions) {
+		o.sampleRate = rate
+	}
+}
+
+// WithSlowThreshold logs the calls slower than d as warnings, zero disables
+// the threshold
+func WithSlowThreshold(d time.Duration) ServerInterceptorOption {
+	return func(o *serverInterceptorOptions) {
+		o.slowThreshold = d
+	}
+}
+
+// accessLog logs a finished call as JSON fields
+// fields holds the fields of the kind of call, e.g. sizes or message counts.
+func (o *serverInterceptorOptions) accessLog(ctx context.Context, log *logger.Logger, method string, startTime time.Time, err error, fields map[string]interface{}) {
+	latency := time.Now().Sub(startTime)
+	code := status.Code(err)
+	slow := o.slowThreshold > 0 && latency > o.slowThreshold
+
+	if err == nil && slow == false && rand.Float64() >= o.sampleRate {
+		return
+	}
+
+	fields["method"] = method
+	fields["code"] = code.String()
+	fields["latency_ms"] = float64(latency) / float64(time.Millisecond)
+	fields["request_id"] = requestIDFromContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields["peer"] = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md.Get("user-agent"); len(ua) > 0 {
+			fields["user_agent"] = ua[0]
+		}
+	}
+	if slow {
+		fields["slow"] = true
+	}
+
+	entry := log.WithFields(fields)
+	switch {
+	case err != nil:
+		entry.WithField("error", err.Error()).Warn("grpc access")
+	case slow:
+		entry.Warn("grpc access")
+	default:
+		entry.Info("grpc access")
+	}
+}
+
+// messageSize returns the encoded size of m, or -1 when m is not a
+// protobuf message
+func messageSize(m interface{}) int {
+	if pm, ok := m.(proto.Message); ok && pm != nil {
+		return proto.Size(pm)
+	}
+
+	return -1
+}
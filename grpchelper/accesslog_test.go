@@ -0,0 +1,127 @@
+package grpchelper
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+func TestAccessLogFields(t *testing.T) {
+	log, out := newTestLogger()
+	i := NewCommonUnaryServerInterceptor(log)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("user-agent", "grpc-go/1.18"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}})
+	ctx = requestid.UpdateContextWithRequestID(ctx, "rid-1")
+
+	req := &healthpb.HealthCheckRequest{Service: "account"}
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	i.TraceInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	})
+
+	entries := out.entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("entries = %v, want 1", entries)
+	}
+
+	e := entries[0]
+	want := map[string]interface{}{
+		"@level":     "warning",
+		"method":     info.FullMethod,
+		"code":       "NotFound",
+		"request_id": "rid-1",
+		"peer":       "10.0.0.1:5000",
+		"user_agent": "grpc-go/1.18",
+		"req_size":   float64(9),
+		"resp_size":  float64(-1),
+		"error":      "rpc error: code = NotFound desc = unknown service",
+	}
+	for k, v := range want {
+		if e[k] != v {
+			t.Errorf("%s = %v, want %v", k, e[k], v)
+		}
+	}
+	if _, ok := e["latency_ms"].(float64); ok == false {
+		t.Errorf("latency_ms = %v, want a number", e["latency_ms"])
+	}
+	if _, ok := e["slow"]; ok {
+		t.Errorf("a fast call is logged as slow")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	failed := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, errors.New("failed") }
+	slow := func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(5 * time.Millisecond)
+		return "ok", nil
+	}
+
+	tests := []struct {
+		name    string
+		opts    []ServerInterceptorOption
+		handler grpc.UnaryHandler
+		level   string
+	}{
+		{"logged by default", nil, ok, "info"},
+		{"sampled out", []ServerInterceptorOption{WithSampleRate(0)}, ok, ""},
+		{"failed", []ServerInterceptorOption{WithSampleRate(0)}, failed, "warning"},
+		{"slow", []ServerInterceptorOption{WithSampleRate(0), WithSlowThreshold(time.Millisecond)}, slow, "warning"},
+		{"fast", []ServerInterceptorOption{WithSampleRate(0), WithSlowThreshold(time.Hour)}, slow, ""},
+	}
+
+	for _, tt := range tests {
+		log, out := newTestLogger()
+		i := NewCommonUnaryServerInterceptor(log, tt.opts...)
+		i.TraceInterceptor(context.Background(), nil, info, tt.handler)
+
+		entries := out.entries(t)
+		if tt.level == "" {
+			if len(entries) != 0 {
+				t.Errorf("%s: entries = %v, want none", tt.name, entries)
+			}
+			continue
+		}
+		if len(entries) != 1 || entries[0]["@level"] != tt.level {
+			t.Errorf("%s: entries = %v, want one at %s", tt.name, entries, tt.level)
+			continue
+		}
+		if tt.name == "slow" && entries[0]["slow"] != true {
+			t.Errorf("%s: the call is not logged as slow", tt.name)
+		}
+	}
+}
+
+func TestMessageSize(t *testing.T) {
+	tests := []struct {
+		name string
+		m    interface{}
+		size int
+	}{
+		{"message", &healthpb.HealthCheckRequest{Service: "account"}, 9},
+		{"empty message", &healthpb.HealthCheckRequest{}, 0},
+		{"nil message", (*healthpb.HealthCheckRequest)(nil), 0},
+		{"nil", nil, -1},
+		{"not a pointer", healthpb.HealthCheckRequest{}, -1},
+		{"not a message", "account", -1},
+	}
+
+	for _, tt := range tests {
+		if size := messageSize(tt.m); size != tt.size {
+			t.Errorf("%s: messageSize = %d, want %d", tt.name, size, tt.size)
+		}
+	}
+}
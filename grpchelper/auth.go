@@ -0,0 +1,362 @@
+package grpchelper
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+const (
+	// AuthMethodJWT is the method of principals authenticated by JWT
+	AuthMethodJWT = "jwt"
+	// AuthMethodAPIKey is the method of principals authenticated by API key
+	AuthMethodAPIKey = "apikey"
+	// AuthMethodMTLS is the method of principals authenticated by client
+	// certificate
+	AuthMethodMTLS = "mtls"
+
+	// DefaultAPIKeyHeader is the metadata key of API keys
+	DefaultAPIKeyHeader = "x-api-key"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the call carries
+// no credentials of its kind, the next Authenticator is tried then
+var ErrNoCredentials = errors.New("auth: no credentials")
+
+// Principal is an authenticated caller
+type Principal struct {
+	// ID is the sub claim, the name of the API key, the SPIFFE ID or the
+	// common name of the certificate
+	ID string
+	// Method is the AuthMethod that authenticated the principal
+	Method string
+	// Claims are the JWT claims
+	Claims map[string]interface{}
+}
+
+type principalKey struct{}
+
+// ContextWithPrincipal returns a context that carries p
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal authenticated by AuthInterceptor
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+
+	return p, ok && p != nil
+}
+
+// Authenticator authenticates the caller of a call
+// It returns ErrNoCredentials when ctx carries no credentials of its kind.
+// Failures that are not about the credentials, e.g. of a key store, are
+// returned as grpc status errors such as codes.Unavailable; other errors
+// reject the credentials.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (*Principal, error)
+}
+
+// AuthInterceptor authenticates every call by a chain of Authenticators
+// The first Authenticator that finds credentials decides, and its principal
+// is put into the context, see PrincipalFromContext. Calls without valid
+// credentials fail with codes.Unauthenticated. The health service is public
+// by default; server reflection is not, since it lists every method, use
+// WithPublicMethods("/grpc.reflection.v1alpha.ServerReflection/") in dev.
+type AuthInterceptor struct {
+	authenticators []Authenticator
+	public         map[string]bool
+	publicPrefixes []string
+
+	log *logger.Logger
+}
+
+// AuthOption configures an AuthInterceptor
+type AuthOption func(i *AuthInterceptor)
+
+// WithPublicMethods does not authenticate calls to methods
+// A method is a full method, e.g. /account.Account/Get, or a service
+// prefix ending with a slash, e.g. /account.Public/
+func WithPublicMethods(methods ...string) AuthOption {
+	return func(i *AuthInterceptor) {
+		for _, m := range methods {
+			if strings.HasSuffix(m, "/") {
+				i.publicPrefixes = append(i.publicPrefixes, m)
+				continue
+			}
+			i.public[m] = true
+		}
+	}
+}
+
+// NewAuthInterceptor returns an AuthInterceptor that tries authenticators in
+// order
+func NewAuthInterceptor(log *logger.Logger, authenticators []Authenticator, opts ...AuthOption) *AuthInterceptor {
+	i := &AuthInterceptor{
+		authenticators: authenticators,
+		public:         make(map[string]bool),
+		publicPrefixes: []string{
+			"/grpc.health.v1.Health/",
+		},
+
+		log: log,
+	}
+
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	return i
+}
+
+// UnaryInterceptor is a grpc.UnaryServerInterceptor
+func (i *AuthInterceptor) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := i.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// StreamInterceptor is a grpc.StreamServerInterceptor
+func (i *AuthInterceptor) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	w := WrapServerStream(ss)
+
+	ctx, err := i.authenticate(w.WrappedContext, info.FullMethod)
+	if err != nil {
+		return err
+	}
+	w.WrappedContext = ctx
+
+	return handler(srv, w)
+}
+
+// authenticate returns a context that carries the principal of the call
+func (i *AuthInterceptor) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if i.isPublic(method) {
+		return ctx, nil
+	}
+
+	for _, a := range i.authenticators {
+		p, err := a.Authenticate(ctx)
+		if err == ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			// The reason is logged only, so that callers cannot probe it
+			if st, ok := status.FromError(err); ok {
+				i.log.Errorf("auth: %s failed. RequestID: %v, err: %v", method, requestIDFromContext(ctx), err)
+				return ctx, status.Error(st.Code(), "authentication failed")
+			}
+			i.log.Warnf("auth: %s rejected. RequestID: %v, err: %v", method, requestIDFromContext(ctx), err)
+			return ctx, status.Error(codes.Unauthenticated, "invalid credentials")
+		}
+		return ContextWithPrincipal(ctx, p), nil
+	}
+
+	return ctx, status.Error(codes.Unauthenticated, "missing credentials")
+}
+
+// isPublic returns true when method is not authenticated
+func (i *AuthInterceptor) isPublic(method string) bool {
+	if i.public[method] {
+		return true
+	}
+
+	for _, prefix := range i.publicPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIKeyStore looks up the principal of an API key
+type APIKeyStore interface {
+	// Lookup returns nil when key is unknown, and an error when the store
+	// fails
+	Lookup(ctx context.Context, key string) (*Principal, error)
+}
+
+// StaticAPIKeys is an APIKeyStore that maps API keys to principal IDs
+type StaticAPIKeys map[string]string
+
+// Lookup implements APIKeyStore
+// Every key is compared in constant time, so that timing does not leak keys.
+func (s StaticAPIKeys) Lookup(ctx context.Context, key string) (*Principal, error) {
+	digest := sha256.Sum256([]byte(key))
+
+	var found *Principal
+	for k, id := range s {
+		d := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(digest[:], d[:]) == 1 {
+			found = &Principal{ID: id, Method: AuthMethodAPIKey}
+		}
+	}
+
+	return found, nil
+}
+
+// APIKeyAuthenticator authenticates the API key of a metadata header
+type APIKeyAuthenticator struct {
+	store  APIKeyStore
+	header string
+}
+
+// NewAPIKeyAuthenticator returns an APIKeyAuthenticator that checks the keys
+// of header against store, an empty header is DefaultAPIKeyHeader
+func NewAPIKeyAuthenticator(store APIKeyStore, header string) *APIKeyAuthenticator {
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+
+	return &APIKeyAuthenticator{
+		store:  store,
+		header: strings.ToLower(header),
+	}
+}
+
+// Authenticate implements Authenticator
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(a.header)
+	if len(keys) == 0 || keys[0] == "" {
+		return nil, ErrNoCredentials
+	}
+
+	p, err := a.store.Lookup(ctx, keys[0])
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Error(codes.Unavailable, "apikey: lookup: "+err.Error())
+	}
+	if p == nil {
+		return nil, errors.New("apikey: unknown key")
+	}
+
+	return p, nil
+}
+
+// MTLSAuthenticator authenticates the verified client certificate of the
+// TLS connection
+// The principal ID is the SPIFFE ID (spiffe://trust-domain/path) of the
+// certificate, or its common name when it has no SPIFFE ID. The server
+// must verify client certificates, e.g. by tls.RequireAndVerifyClientCert.
+type MTLSAuthenticator struct {
+	trustDomains map[string]bool
+}
+
+// NewMTLSAuthenticator returns a MTLSAuthenticator
+// When trust domains are given, only SPIFFE IDs of those domains are
+// accepted and common names are not.
+func NewMTLSAuthenticator(trustDomains ...string) *MTLSAuthenticator {
+	a := &MTLSAuthenticator{
+		trustDomains: make(map[string]bool, len(trustDomains)),
+	}
+	for _, d := range trustDomains {
+		a.trustDomains[d] = true
+	}
+
+	return a
+}
+
+// Authenticate implements Authenticator
+func (a *MTLSAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	p, ok := peer.FromContext(ctx)
+	if ok == false {
+		return nil, ErrNoCredentials
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if ok == false || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := info.State.VerifiedChains[0][0]
+
+	uris, err := certURIs(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range uris {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		if len(a.trustDomains) > 0 && a.trustDomains[u.Host] == false {
+			return nil, errors.New("mtls: untrusted SPIFFE trust domain " + u.Host)
+		}
+		return &Principal{ID: spiffeID(u), Method: AuthMethodMTLS}, nil
+	}
+
+	if len(a.trustDomains) > 0 {
+		return nil, errors.New("mtls: certificate has no SPIFFE ID")
+	}
+	if cert.Subject.CommonName == "" {
+		return nil, errors.New("mtls: certificate has no common name")
+	}
+
+	return &Principal{ID: cert.Subject.CommonName, Method: AuthMethodMTLS}, nil
+}
+
+// spiffeID returns the SPIFFE ID of u
+func spiffeID(u *url.URL) string {
+	return "spiffe://" + u.Host + u.EscapedPath()
+}
+
+// oidSubjectAltName is the OID of the subject alternative name extension
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// certURIs returns the URIs of the subject alternative names of cert
+// x509.Certificate.URIs is not used, it requires Go 1.10.
+func certURIs(cert *x509.Certificate) ([]*url.URL, error) {
+	var uris []*url.URL
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSubjectAltName) == false {
+			continue
+		}
+
+		var seq asn1.RawValue
+		rest, err := asn1.Unmarshal(ext.Value, &seq)
+		if err != nil || len(rest) != 0 || seq.Class != asn1.ClassUniversal || seq.Tag != asn1.TagSequence {
+			return nil, errors.New("mtls: invalid subject alternative names")
+		}
+
+		rest = seq.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			rest, err = asn1.Unmarshal(rest, &name)
+			if err != nil {
+				return nil, errors.New("mtls: invalid subject alternative names")
+			}
+
+			// uniformResourceIdentifier [6] IA5String
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 6 {
+				continue
+			}
+			u, err := url.Parse(string(name.Bytes))
+			if err != nil {
+				return nil, errors.New("mtls: invalid URI subject alternative name")
+			}
+			uris = append(uris, u)
+		}
+	}
+
+	return uris, nil
+}
@@ -0,0 +1,296 @@
+package grpchelper
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "n": %q, "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()))
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewJWTAuthenticator(keys, WithIssuer("auth"), WithAudience("account"))
+	now := time.Now().Unix()
+
+	// ES256
+	signed := encodeSegment(map[string]string{"alg": "ES256", "kid": "ec"}) + "." +
+		encodeSegment(map[string]interface{}{"sub": "bob", "iss": "auth", "aud": []string{"account"}, "exp": now + 60})
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	// HS256 signed with the public RSA key must not verify
+	confused := encodeSegment(map[string]string{"alg": "HS256", "kid": "rsa"}) + "." +
+		encodeSegment(map[string]interface{}{"sub": "eve", "iss": "auth", "aud": "account"})
+
+	tests := []struct {
+		name  string
+		token string
+		sub   string
+	}{
+		{"rs256", signRS256(t, rsaKey, "rsa", map[string]interface{}{"sub": "alice", "iss": "auth", "aud": "account", "exp": now + 60}), "alice"},
+		{"es256", signed + "." + base64.RawURLEncoding.EncodeToString(sig), "bob"},
+		{"expired", signRS256(t, rsaKey, "rsa", map[string]interface{}{"sub": "alice", "iss": "auth", "aud": "account", "exp": now - 60}), ""},
+		{"audience", signRS256(t, rsaKey, "rsa", map[string]interface{}{"sub": "alice", "iss": "auth", "aud": "order"}), ""},
+		{"unknown key", signRS256(t, rsaKey, "other", map[string]interface{}{"sub": "alice", "iss": "auth", "aud": "account"}), ""},
+		{"alg confusion", confused + "." + base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()), ""},
+		{"malformed", "a.b", ""},
+	}
+
+	for _, tt := range tests {
+		p, err := a.Verify(tt.token)
+		if tt.sub == "" {
+			if err == nil {
+				t.Errorf("%s: token should be rejected", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.ID != tt.sub || p.Method != AuthMethodJWT {
+			t.Errorf("%s: principal = %+v", tt.name, p)
+		}
+	}
+}
+
+func TestJWTAuthenticatorCurve(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewJWTAuthenticator(JWTKeySet{"ec": &ecKey.PublicKey})
+
+	// a valid signature of a P-256 key over a SHA-384 digest
+	signed := encodeSegment(map[string]string{"alg": "ES384", "kid": "ec"}) + "." +
+		encodeSegment(map[string]interface{}{"sub": "eve"})
+	digest := sha512.Sum384([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	if _, err := a.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(sig)); err == nil {
+		t.Error("ES384 with a P-256 key should be rejected")
+	}
+}
+
+func TestParseJWKSInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"empty secret", `{"kty": "oct", "kid": "hs"}`},
+		{"malformed secret", `{"kty": "oct", "kid": "hs", "k": "!"}`},
+		{"unsupported curve", `{"kty": "EC", "kid": "ec", "crv": "P-224", "x": "AQ", "y": "AQ"}`},
+		{"point not on curve", `{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "AQ", "y": "AQ"}`},
+		{"unsupported key type", `{"kty": "OKP", "kid": "ed"}`},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseJWKS([]byte(`{"keys": [` + tt.key + `]}`)); err == nil {
+			t.Errorf("%s: the key should be rejected", tt.name)
+		}
+	}
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	i := NewAuthInterceptor(&logger.Logger{}, []Authenticator{
+		NewJWTAuthenticator(JWTKeySet{}),
+		NewAPIKeyAuthenticator(StaticAPIKeys{"secret": "billing"}, ""),
+	})
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		p, ok := PrincipalFromContext(ctx)
+		if ok == false {
+			return nil, nil
+		}
+		return p.ID, nil
+	}
+
+	tests := []struct {
+		md   metadata.MD
+		id   interface{}
+		code codes.Code
+	}{
+		{metadata.Pairs("x-api-key", "secret"), "billing", codes.OK},
+		{metadata.Pairs("x-api-key", "wrong"), nil, codes.Unauthenticated},
+		{metadata.Pairs("authorization", "Bearer a.b.c"), nil, codes.Unauthenticated},
+		{metadata.MD{}, nil, codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+		id, err := i.UnaryInterceptor(ctx, nil, info, handler)
+		if status.Code(err) != tt.code || id != tt.id {
+			t.Errorf("%v: got %v, %v", tt.md, id, err)
+		}
+	}
+
+	failing := NewAuthInterceptor(&logger.Logger{}, []Authenticator{NewAPIKeyAuthenticator(failingKeyStore{}, "")})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "secret"))
+	if _, err := failing.UnaryInterceptor(ctx, nil, info, handler); status.Code(err) != codes.Unavailable {
+		t.Errorf("a failing key store should be unavailable, got %v", err)
+	}
+
+	health := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	if _, err := i.UnaryInterceptor(context.Background(), nil, health, handler); err != nil {
+		t.Errorf("health should be public: %v", err)
+	}
+	reflection := &grpc.UnaryServerInfo{FullMethod: "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"}
+	if _, err := i.UnaryInterceptor(context.Background(), nil, reflection, handler); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("reflection should not be public: %v", err)
+	}
+}
+
+type failingKeyStore struct{}
+
+func (failingKeyStore) Lookup(ctx context.Context, key string) (*Principal, error) {
+	return nil, errors.New("connection refused")
+}
+
+// testCertificate returns a certificate of cn whose subject alternative
+// names are uris, built without x509.Certificate.URIs
+func testCertificate(t *testing.T, cn string, uris ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if len(uris) > 0 {
+		var names []asn1.RawValue
+		for _, u := range uris {
+			names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(u)})
+		}
+		value, err := asn1.Marshal(names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: value}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestMTLSAuthenticator(t *testing.T) {
+	spiffe := testCertificate(t, "billing", "https://example.com", "spiffe://prod.example.com/billing")
+	plain := testCertificate(t, "billing")
+
+	tests := []struct {
+		name         string
+		cert         *x509.Certificate
+		trustDomains []string
+		id           string
+	}{
+		{"spiffe", spiffe, nil, "spiffe://prod.example.com/billing"},
+		{"trusted domain", spiffe, []string{"prod.example.com"}, "spiffe://prod.example.com/billing"},
+		{"untrusted domain", spiffe, []string{"dev.example.com"}, ""},
+		{"common name", plain, nil, "billing"},
+		{"no spiffe id", plain, []string{"prod.example.com"}, ""},
+	}
+
+	for _, tt := range tests {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}},
+		})
+
+		p, err := NewMTLSAuthenticator(tt.trustDomains...).Authenticate(ctx)
+		if tt.id == "" {
+			if err == nil {
+				t.Errorf("%s: certificate should be rejected", tt.name)
+			}
+			continue
+		}
+		if err != nil || p.ID != tt.id || p.Method != AuthMethodMTLS {
+			t.Errorf("%s: got %+v, %v", tt.name, p, err)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package grpchelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+// PolicyRule allows the calls to Methods for the principals it lists
+// A method is a full method (/account.Account/Get), a service pattern
+// (/account.Account/*) or * for every method. A principal is allowed when
+// its name is in Principals (see PrincipalName), or it has one of Roles
+// (roles claim) or Scopes (scope or scp claim).
+type PolicyRule struct {
+	Methods    []string `json:"methods"`
+	Principals []string `json:"principals,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	// Authenticated allows every authenticated principal
+	Authenticated bool `json:"authenticated,omitempty"`
+	// Public allows every caller, including unauthenticated ones
+	Public bool `json:"public,omitempty"`
+}
+
+// Policy maps methods to the principals allowed to call them
+// The first rule that matches a method decides, the calls to methods that
+// match no rule are denied unless DefaultAllow is set.
+type Policy struct {
+	Rules        []PolicyRule `json:"rules"`
+	DefaultAllow bool         `json:"default_allow,omitempty"`
+}
+
+// ParsePolicy returns a Policy parsed from JSON, e.g.
+//     {"rules": [
+//         {"methods": ["/grpc.health.v1.Health/*"], "public": true},
+//         {"methods": ["/account.Account/Delete"], "roles": ["admin"]},
+//         {"methods": ["/account.Account/*"], "scopes": ["account"], "principals": ["apikey:billing_service"]}
+//     ]}
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range policy.Rules {
+		if len(rule.Methods) == 0 {
+			return nil, fmt.Errorf("policy: rule %d has no methods", i)
+		}
+	}
+
+	return policy, nil
+}
+
+// LoadPolicy returns a Policy read from a JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(data)
+}
+
+// Allowed returns true when p can call method, with the reason of the
+// decision
+// p is nil for unauthenticated callers.
+func (policy *Policy) Allowed(method string, p *Principal) (bool, string) {
+	for i, rule := range policy.Rules {
+		if rule.matchMethod(method) == false {
+			continue
+		}
+
+		if rule.allows(p) {
+			return true, fmt.Sprintf("allowed by rule %d", i)
+		}
+		return false, fmt.Sprintf("denied by rule %d", i)
+	}
+
+	if policy.DefaultAllow {
+		return true, "allowed by default"
+	}
+
+	return false, "no rule matches the method"
+}
+
+// matchMethod returns true when the rule applies to method
+func (rule *PolicyRule) matchMethod(method string) bool {
+	for _, m := range rule.Methods {
+		if matchMethodPattern(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchMethodPattern returns true when method matches pattern, a full method
+// (/account.Account/Get), a service pattern (/account.Account/*) or *
+func matchMethodPattern(pattern, method string) bool {
+	switch {
+	case pattern == "*" || pattern == method:
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(method, pattern[:len(pattern)-1])
+	}
+
+	return false
+}
+
+// allows returns true when the rule allows p
+func (rule *PolicyRule) allows(p *Principal) bool {
+	if rule.Public {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if rule.Authenticated {
+		return true
+	}
+
+	name := PrincipalName(p)
+	for _, n := range rule.Principals {
+		if n == name {
+			return true
+		}
+	}
+
+	roles := claimValues(p.Claims, "roles", "")
+	for _, role := range rule.Roles {
+		if roles[role] {
+			return true
+		}
+	}
+
+	scopes := claimValues(p.Claims, "scope", " ")
+	for s := range claimValues(p.Claims, "scp", " ") {
+		scopes[s] = true
+	}
+	for _, scope := range rule.Scopes {
+		if scopes[scope] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrincipalName returns the name of p in PolicyRule.Principals, qualified
+// by its auth method so that principals of different methods never match
+// each other:
+//     apikey:<key name>
+//     jwt:<iss>/<sub>, or jwt:<sub> without iss claim
+//     spiffe://<trust domain>/<path>
+//     mtls:<common name>
+func PrincipalName(p *Principal) string {
+	switch p.Method {
+	case AuthMethodJWT:
+		if iss, ok := p.Claims["iss"].(string); ok && iss != "" {
+			return AuthMethodJWT + ":" + iss + "/" + p.ID
+		}
+	case AuthMethodMTLS:
+		if strings.HasPrefix(p.ID, "spiffe://") {
+			return p.ID
+		}
+	}
+
+	return p.Method + ":" + p.ID
+}
+
+// claimValues returns the values of a string or string array claim
+// A string is split by sep when sep is not empty.
+func claimValues(claims map[string]interface{}, name, sep string) map[string]bool {
+	values := make(map[string]bool)
+
+	switch v := claims[name].(type) {
+	case string:
+		if sep == "" {
+			values[v] = true
+			break
+		}
+		for _, s := range strings.Split(v, sep) {
+			if s != "" {
+				values[s] = true
+			}
+		}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values[s] = true
+			}
+		}
+	}
+
+	return values
+}
+
+// Authorizer enforces a Policy on every call
+// The principal is the one put into the context by AuthInterceptor, which
+// must run before. Denied calls fail with codes.PermissionDenied, or with
+// codes.Unauthenticated when they carry no principal, and are written to
+// the audit log. The policy can be swapped at any time, e.g. by
+// Watch when the policy file changes.
+type Authorizer struct {
+	policy atomic.Value
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	modTime time.Time
+
+	log *logger.Logger
+}
+
+// NewAuthorizer returns an Authorizer that enforces policy
+func NewAuthorizer(policy *Policy, log *logger.Logger) *Authorizer {
+	a := &Authorizer{
+		log: log,
+	}
+	a.SetPolicy(policy)
+
+	return a
+}
+
+// SetPolicy replaces the policy of Authorizer, a nil policy denies every call
+func (a *Authorizer) SetPolicy(policy *Policy) {
+	if policy == nil {
+		policy = &Policy{}
+	}
+
+	a.policy.Store(policy)
+}
+
+// GetPolicy returns the policy currently enforced
+func (a *Authorizer) GetPolicy() *Policy {
+	return a.policy.Load().(*Policy)
+}
+
+// Reload replaces the policy with the policy read from a JSON file
+// The current policy is kept when the file is invalid
+func (a *Authorizer) Reload(path string) error {
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		return err
+	}
+
+	a.SetPolicy(policy)
+
+	return nil
+}
+
+// Watch reloads the policy file at path whenever it changes, checking every
+// interval until Close
+func (a *Authorizer) Watch(path string, interval time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stop != nil {
+		close(a.stop)
+	}
+	stop := make(chan struct{})
+	a.stop = stop
+
+	if fi, err := os.Stat(path); err == nil {
+		a.modTime = fi.ModTime()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				a.reloadIfChanged(path)
+			}
+		}
+	}()
+}
+
+// reloadIfChanged reloads the policy file when its modification time changed
+func (a *Authorizer) reloadIfChanged(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		a.log.Warnf("authz: stat policy %s: %v", path, err)
+		return
+	}
+
+	a.mu.Lock()
+	changed := fi.ModTime().Equal(a.modTime) == false
+	a.modTime = fi.ModTime()
+	a.mu.Unlock()
+
+	if changed == false {
+		return
+	}
+
+	if err := a.Reload(path); err != nil {
+		a.log.Errorf("authz: reload policy %s, the current policy is kept: %v", path, err)
+		return
+	}
+
+	a.log.Infof("authz: policy %s reloaded", path)
+}
+
+// Close stops watching the policy file
+func (a *Authorizer) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+}
+
+// UnaryInterceptor is a grpc.UnaryServerInterceptor
+func (a *Authorizer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// StreamInterceptor is a grpc.StreamServerInterceptor
+func (a *Authorizer) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
+
+// authorize returns an error when the principal of ctx cannot call method
+func (a *Authorizer) authorize(ctx context.Context, method string) error {
+	p, _ := PrincipalFromContext(ctx)
+
+	allowed, reason := a.GetPolicy().Allowed(method, p)
+	if allowed {
+		return nil
+	}
+
+	fields := map[string]interface{}{
+		"audit":      true,
+		"decision":   "deny",
+		"method":     method,
+		"reason":     reason,
+		"request_id": requestIDFromContext(ctx),
+	}
+	if p != nil {
+		fields["principal"] = PrincipalName(p)
+		fields["auth_method"] = p.Method
+	}
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+		fields["peer"] = pr.Addr.String()
+	}
+	a.log.WithFields(fields).Warn("authz denied")
+
+	if p == nil {
+		return status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+
+	return status.Error(codes.PermissionDenied, "permission denied")
+}
@@ -0,0 +1,176 @@
+package grpchelper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"rules": [
+		{"methods": ["/grpc.health.v1.Health/*"], "public": true},
+		{"methods": ["/account.Account/Delete"], "roles": ["admin"]},
+		{"methods": ["/account.Account/*"], "scopes": ["account"], "principals": ["apikey:billing_service", "jwt:https://idp.example.com/reporting"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &Principal{ID: "alice", Method: AuthMethodJWT, Claims: map[string]interface{}{"roles": []interface{}{"admin"}}}
+	reader := &Principal{ID: "bob", Method: AuthMethodJWT, Claims: map[string]interface{}{"scope": "openid account"}}
+	billing := &Principal{ID: "billing_service", Method: AuthMethodAPIKey}
+	reporting := &Principal{ID: "reporting", Method: AuthMethodJWT, Claims: map[string]interface{}{"iss": "https://idp.example.com"}}
+	jwtBilling := &Principal{ID: "billing_service", Method: AuthMethodJWT}
+	certBilling := &Principal{ID: "billing_service", Method: AuthMethodMTLS}
+
+	tests := []struct {
+		method  string
+		p       *Principal
+		allowed bool
+	}{
+		{"/grpc.health.v1.Health/Check", nil, true},
+		{"/account.Account/Delete", admin, true},
+		{"/account.Account/Delete", reader, false},
+		{"/account.Account/Get", reader, true},
+		{"/account.Account/Get", billing, true},
+		{"/account.Account/Get", reporting, true},
+		{"/account.Account/Get", jwtBilling, false},
+		{"/account.Account/Get", certBilling, false},
+		{"/account.Account/Get", admin, false},
+		{"/account.Account/Get", nil, false},
+		{"/order.Order/Get", admin, false},
+	}
+
+	for _, tt := range tests {
+		if allowed, reason := policy.Allowed(tt.method, tt.p); allowed != tt.allowed {
+			t.Errorf("Allowed(%s, %+v) = %v (%s), want %v", tt.method, tt.p, allowed, reason, tt.allowed)
+		}
+	}
+}
+
+func TestPrincipalName(t *testing.T) {
+	tests := []struct {
+		p    *Principal
+		name string
+	}{
+		{&Principal{ID: "billing", Method: AuthMethodAPIKey}, "apikey:billing"},
+		{&Principal{ID: "bob", Method: AuthMethodJWT}, "jwt:bob"},
+		{&Principal{ID: "bob", Method: AuthMethodJWT, Claims: map[string]interface{}{"iss": "https://idp"}}, "jwt:https://idp/bob"},
+		{&Principal{ID: "spiffe://prod/billing", Method: AuthMethodMTLS}, "spiffe://prod/billing"},
+		{&Principal{ID: "billing", Method: AuthMethodMTLS}, "mtls:billing"},
+	}
+
+	for _, tt := range tests {
+		if name := PrincipalName(tt.p); name != tt.name {
+			t.Errorf("PrincipalName(%+v) = %s, want %s", tt.p, name, tt.name)
+		}
+	}
+}
+
+func TestAuthorizerInterceptors(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{{Methods: []string{"/account.Account/*"}, Principals: []string{"apikey:billing"}}}}
+	log, out := newTestLogger()
+	a := NewAuthorizer(policy, log)
+
+	billing := ContextWithPrincipal(context.Background(), &Principal{ID: "billing", Method: AuthMethodAPIKey})
+	other := ContextWithPrincipal(context.Background(), &Principal{ID: "billing", Method: AuthMethodJWT})
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	if resp, err := a.UnaryInterceptor(billing, nil, info, handler); err != nil || resp != "ok" {
+		t.Errorf("allowed call: got %v, %v", resp, err)
+	}
+	if _, err := a.UnaryInterceptor(other, nil, info, handler); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("denied call: got %v", err)
+	}
+	if _, err := a.UnaryInterceptor(context.Background(), nil, info, handler); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call without principal: got %v", err)
+	}
+
+	streamInfo := &grpc.StreamServerInfo{FullMethod: "/account.Account/List"}
+	streamHandler := func(srv interface{}, ss grpc.ServerStream) error { return nil }
+
+	if err := a.StreamInterceptor(nil, &testServerStream{ctx: billing}, streamInfo, streamHandler); err != nil {
+		t.Errorf("allowed stream: got %v", err)
+	}
+	if err := a.StreamInterceptor(nil, &testServerStream{ctx: other}, streamInfo, streamHandler); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("denied stream: got %v", err)
+	}
+	if err := a.StreamInterceptor(nil, &testServerStream{ctx: context.Background()}, streamInfo, streamHandler); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("stream without principal: got %v", err)
+	}
+
+	entries := out.entries(t)
+	if len(entries) != 4 {
+		t.Fatalf("denials should be audited, got %v", entries)
+	}
+	if e := entries[0]; e["audit"] != true || e["decision"] != "deny" || e["method"] != "/account.Account/Get" ||
+		e["principal"] != "jwt:billing" || e["auth_method"] != AuthMethodJWT || e["reason"] != "denied by rule 0" {
+		t.Errorf("unexpected audit entry: %v", e)
+	}
+	if e := entries[3]; e["method"] != "/account.Account/List" || e["principal"] != nil {
+		t.Errorf("unexpected audit entry: %v", e)
+	}
+}
+
+func TestAuthorizerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.json")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"rules": [{"methods": ["*"], "public": true}]}`)
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAuthorizer(policy, &logger.Logger{})
+	a.Watch(path, 5*time.Millisecond)
+	defer a.Close()
+
+	waitPolicy := func(allowed bool) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if ok, _ := a.GetPolicy().Allowed("/account.Account/Get", nil); ok == allowed {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("policy should allow: %v", allowed)
+	}
+
+	write(`{"rules": [{"methods": ["*"], "authenticated": true}]}`)
+	waitPolicy(false)
+
+	// an invalid file keeps the current policy
+	write(`{"rules": [{"methods": ["*"], "public": true}`)
+	time.Sleep(50 * time.Millisecond)
+	waitPolicy(false)
+
+	write(`{"rules": [{"methods": ["*"], "public": true}]}`)
+	waitPolicy(true)
+}
@@ -0,0 +1,253 @@
+package grpchelper
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/balancer"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+	"github.com/servicekit/servicekit-go/trace"
+)
+
+const (
+	// ClientHandledCounter is the name of the counter of finished client calls
+	ClientHandledCounter = "grpc_client_handled_total"
+	// ClientHandlingHistogram is the name of the histogram of client call latency
+	ClientHandlingHistogram = "grpc_client_handling_seconds"
+)
+
+// ClientMetricsVecs returns the vectors recorded by CommonClientInterceptor
+func ClientMetricsVecs() []trace.PrometheusVec {
+	return []trace.PrometheusVec{
+		&trace.PrometheusCounter{
+			Name:   ClientHandledCounter,
+			Help:   "Total number of RPCs completed by the client, regardless of success or failure.",
+			Labels: methodCodeLabels,
+		},
+		&trace.PrometheusHistogram{
+			Name:   ClientHandlingHistogram,
+			Help:   "Histogram of response latency (seconds) of the RPCs completed by the client.",
+			Labels: methodLabels,
+		},
+	}
+}
+
+// CommonClientInterceptor describe a client interceptor
+// It attaches the request ID to outgoing metadata, applies default deadlines,
+// logs the calls and records their metrics. The probes of a
+// balancer.HealthChecker are passed through.
+type CommonClientInterceptor struct {
+	log   *logger.Logger
+	trace *trace.Trace
+
+	defaultTimeout time.Duration
+	streamTimeout  time.Duration
+	timeouts       map[string]time.Duration
+}
+
+// ClientInterceptorOption configures a CommonClientInterceptor
+type ClientInterceptorOption func(i *CommonClientInterceptor)
+
+// WithDefaultTimeout sets the deadline of the unary calls whose caller set
+// none
+// Streams are not given it, since they often live longer than any call,
+// see WithStreamTimeout.
+func WithDefaultTimeout(d time.Duration) ClientInterceptorOption {
+	return func(i *CommonClientInterceptor) {
+		i.defaultTimeout = d
+	}
+}
+
+// WithStreamTimeout sets the deadline of the streams whose caller set none
+// The timeout is released when the stream ends, see StreamInterceptor. A
+// server stream that the caller stops reading before its end keeps it until
+// the deadline, unless the caller cancels its context.
+func WithStreamTimeout(d time.Duration) ClientInterceptorOption {
+	return func(i *CommonClientInterceptor) {
+		i.streamTimeout = d
+	}
+}
+
+// WithMethodTimeout sets the deadline of the calls to method whose caller
+// set none, method is the full method, e.g. /account.Account/Get
+// It overrides WithDefaultTimeout, or WithStreamTimeout for a stream.
+func WithMethodTimeout(method string, d time.Duration) ClientInterceptorOption {
+	return func(i *CommonClientInterceptor) {
+		i.timeouts[method] = d
+	}
+}
+
+// NewCommonClientInterceptor returns a CommonClientInterceptor
+// t can be nil, then no metrics are recorded. Otherwise the vectors of
+// ClientMetricsVecs are registered to t.
+func NewCommonClientInterceptor(log *logger.Logger, t *trace.Trace, opts ...ClientInterceptorOption) *CommonClientInterceptor {
+	i := &CommonClientInterceptor{
+		log:      log,
+		trace:    t,
+		timeouts: make(map[string]time.Duration),
+	}
+
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	if t != nil {
+		if err := t.Register(ClientMetricsVecs()...); err != nil {
+			log.Errorf("grpchelper: register client metrics: %v", err)
+		}
+	}
+
+	return i
+}
+
+// UnaryInterceptor is a grpc.UnaryClientInterceptor
+func (i *CommonClientInterceptor) UnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if balancer.IsHealthProbe(ctx) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	ctx, rid := withOutgoingRequestID(ctx)
+
+	ctx, cancel := i.withTimeout(ctx, method, i.defaultTimeout)
+	defer cancel()
+
+	startTime := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	i.done(typeUnary, method, rid, startTime, err)
+
+	return err
+}
+
+// StreamInterceptor is a grpc.StreamClientInterceptor
+// The stream is logged and recorded when it ends, that is when RecvMsg
+// returns an error or io.EOF, or the single response of a stream without
+// server streaming, e.g. by CloseAndRecv.
+func (i *CommonClientInterceptor) StreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if balancer.IsHealthProbe(ctx) {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
+	ctx, rid := withOutgoingRequestID(ctx)
+
+	ctx, cancel := i.withTimeout(ctx, method, i.streamTimeout)
+	grpcType := clientStreamType(desc)
+
+	startTime := time.Now()
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		i.done(grpcType, method, rid, startTime, err)
+		return nil, err
+	}
+
+	return &monitoredClientStream{
+		ClientStream:  s,
+		serverStreams: desc.ServerStreams,
+		finish: func(err error) {
+			cancel()
+			i.done(grpcType, method, rid, startTime, err)
+		},
+	}, nil
+}
+
+// withTimeout applies the deadline of method, or else defaultTimeout, when
+// ctx has none
+func (i *CommonClientInterceptor) withTimeout(ctx context.Context, method string, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+
+	timeout, ok := i.timeouts[method]
+	if ok == false {
+		timeout = defaultTimeout
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// done logs a finished call and records its metrics
+func (i *CommonClientInterceptor) done(grpcType, method, rid string, startTime time.Time, err error) {
+	doneTime := time.Now().Sub(startTime)
+	code := status.Code(err)
+
+	if err != nil {
+		i.log.Warnf("GRPC Client: %v failed. RequestID: %v, code: %v, time: %v, err: %v", method, rid, code, doneTime.String(), err)
+	} else {
+		i.log.Infof("GRPC Client: %v done. RequestID: %v, code: %v, time: %v", method, rid, code, doneTime.String())
+	}
+
+	if i.trace == nil {
+		return
+	}
+	labels := methodLabelValues(grpcType, method)
+	if c := i.trace.GetCounter(ClientHandledCounter); c != nil {
+		c.WithLabelValues(append(labels, code.String())...).Inc()
+	}
+	if h := i.trace.GetHistogram(ClientHandlingHistogram); h != nil {
+		h.WithLabelValues(labels...).Observe(doneTime.Seconds())
+	}
+}
+
+// clientStreamType returns the grpc_type of a client stream
+func clientStreamType(desc *grpc.StreamDesc) string {
+	switch {
+	case desc.ClientStreams && desc.ServerStreams:
+		return typeBidiStream
+	case desc.ClientStreams:
+		return typeClientStream
+	}
+
+	return typeServerStream
+}
+
+// withOutgoingRequestID attaches the request ID of ctx to outgoing metadata
+// A request ID in outgoing metadata already is kept, a new one is created
+// when ctx carries none.
+func withOutgoingRequestID(ctx context.Context) (context.Context, string) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if values := md.Get(requestid.RequestIDKey); len(values) > 0 && values[0] != "" {
+		return ctx, values[0]
+	}
+
+	rid := requestIDFromContext(ctx)
+	if rid == "" {
+		rid = requestid.HandleRequestID(ctx)
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, requestid.RequestIDKey, rid), rid
+}
+
+// monitoredClientStream calls finish once when the stream ends
+type monitoredClientStream struct {
+	grpc.ClientStream
+
+	serverStreams bool
+	finish        func(err error)
+	once          sync.Once
+}
+
+func (s *monitoredClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	// without server streaming, the single response ends the stream
+	if err != nil || s.serverStreams == false {
+		s.once.Do(func() {
+			result := err
+			if result == io.EOF {
+				result = nil
+			}
+			s.finish(result)
+		})
+	}
+
+	return err
+}
@@ -0,0 +1,165 @@
+package grpchelper
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+func TestWithOutgoingRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		rid  string
+	}{
+		{"outgoing", metadata.AppendToOutgoingContext(context.Background(), requestid.RequestIDKey, "rid-out"), "rid-out"},
+		{"server call", context.WithValue(context.Background(), requestIDKey{}, "rid-server"), "rid-server"},
+		{"new", context.Background(), ""},
+	}
+
+	for _, tt := range tests {
+		ctx, rid := withOutgoingRequestID(tt.ctx)
+		if rid == "" || (tt.rid != "" && rid != tt.rid) {
+			t.Errorf("%s: request ID = %q, want %q", tt.name, rid, tt.rid)
+		}
+
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if values := md.Get(requestid.RequestIDKey); len(values) != 1 || values[0] != rid {
+			t.Errorf("%s: outgoing request IDs = %v, want [%s]", tt.name, values, rid)
+		}
+	}
+}
+
+func TestClientInterceptorTimeout(t *testing.T) {
+	i := NewCommonClientInterceptor(&logger.Logger{}, nil,
+		WithDefaultTimeout(time.Hour), WithMethodTimeout("/account.Account/Get", time.Minute))
+	streams := NewCommonClientInterceptor(&logger.Logger{}, nil, WithStreamTimeout(time.Minute))
+
+	caller, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	unary := func(i *CommonClientInterceptor, ctx context.Context, method string) (time.Duration, bool) {
+		var timeout time.Duration
+		var ok bool
+		i.UnaryInterceptor(ctx, method, nil, nil, nil, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			var deadline time.Time
+			deadline, ok = ctx.Deadline()
+			timeout = time.Until(deadline)
+			return nil
+		})
+		return timeout, ok
+	}
+	stream := func(i *CommonClientInterceptor, method string) (time.Duration, bool) {
+		var timeout time.Duration
+		var ok bool
+		i.StreamInterceptor(context.Background(), &grpc.StreamDesc{ServerStreams: true}, nil, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			var deadline time.Time
+			deadline, ok = ctx.Deadline()
+			timeout = time.Until(deadline)
+			return nil, status.Error(codes.Unavailable, "unavailable")
+		})
+		return timeout, ok
+	}
+
+	tests := []struct {
+		name    string
+		get     func() (time.Duration, bool)
+		timeout time.Duration
+	}{
+		{"default", func() (time.Duration, bool) { return unary(i, context.Background(), "/account.Account/List") }, time.Hour},
+		{"method", func() (time.Duration, bool) { return unary(i, context.Background(), "/account.Account/Get") }, time.Minute},
+		{"caller deadline", func() (time.Duration, bool) { return unary(i, caller, "/account.Account/Get") }, time.Second},
+		{"no stream timeout", func() (time.Duration, bool) { return stream(i, "/account.Account/Watch") }, 0},
+		{"stream method", func() (time.Duration, bool) { return stream(i, "/account.Account/Get") }, time.Minute},
+		{"stream timeout", func() (time.Duration, bool) { return stream(streams, "/account.Account/Watch") }, time.Minute},
+	}
+
+	for _, tt := range tests {
+		timeout, ok := tt.get()
+		if ok != (tt.timeout > 0) || (ok && (timeout > tt.timeout || timeout < tt.timeout-time.Second)) {
+			t.Errorf("%s: timeout = %v (%v), want %v", tt.name, timeout, ok, tt.timeout)
+		}
+	}
+}
+
+// failingClientStream is a grpc.ClientStream whose RecvMsg fails with err
+type failingClientStream struct {
+	grpc.ClientStream
+
+	ctx context.Context
+	err error
+}
+
+func (s *failingClientStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *failingClientStream) RecvMsg(m interface{}) error {
+	return s.err
+}
+
+func TestClientInterceptorStreamRecvError(t *testing.T) {
+	log, out := newTestLogger()
+	tr := testTrace(t)
+	i := NewCommonClientInterceptor(log, tr, WithStreamTimeout(time.Minute))
+
+	method := "/client.Stream/Watch"
+	var streamCtx context.Context
+	s, err := i.StreamInterceptor(context.Background(), &grpc.StreamDesc{ServerStreams: true}, nil, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		streamCtx = ctx
+		return &failingClientStream{ctx: ctx, err: status.Error(codes.Unavailable, "connection closed")}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RecvMsg(nil); status.Code(err) != codes.Unavailable {
+		t.Fatalf("RecvMsg = %v, want Unavailable", err)
+	}
+	s.RecvMsg(nil)
+
+	if streamCtx.Err() == nil {
+		t.Error("the context of the stream is not canceled once it ends")
+	}
+	if entries := out.entries(t); len(entries) != 1 || entries[0]["@level"] != "warning" {
+		t.Errorf("the failed stream should be logged once, got %v", entries)
+	}
+	c := tr.GetCounter(ClientHandledCounter)
+	if v := counterValue(t, c.WithLabelValues(typeServerStream, "client.Stream", "Watch", "Unavailable")); v != 1 {
+		t.Errorf("%s = %v, want 1", ClientHandledCounter, v)
+	}
+}
+
+func TestClientInterceptorClientStreamEnd(t *testing.T) {
+	log, out := newTestLogger()
+	i := NewCommonClientInterceptor(log, nil, WithStreamTimeout(time.Minute))
+
+	var streamCtx context.Context
+	s, err := i.StreamInterceptor(context.Background(), &grpc.StreamDesc{ClientStreams: true}, nil, "/client.Stream/Upload", func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		streamCtx = ctx
+		return &failingClientStream{ctx: ctx}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CloseAndRecv receives the single response, never io.EOF
+	if err := s.RecvMsg(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if streamCtx.Err() == nil {
+		t.Error("the timeout of the stream is not released once it ends")
+	}
+	if entries := out.entries(t); len(entries) != 1 || entries[0]["@level"] != "info" {
+		t.Errorf("the stream should be logged once, got %v", entries)
+	}
+}
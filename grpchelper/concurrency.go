@@ -0,0 +1,281 @@
+package grpchelper
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/health"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+const (
+	// DefaultInitialConcurrency is the initial limit of in-flight calls
+	DefaultInitialConcurrency = 20
+	// DefaultMinConcurrency is the lowest limit of in-flight calls
+	DefaultMinConcurrency = 1
+	// DefaultMaxConcurrency is the highest limit of in-flight calls
+	DefaultMaxConcurrency = 1000
+	// DefaultLatencyTarget is the latency above which a call is a congestion
+	// signal
+	DefaultLatencyTarget = time.Second
+	// DefaultBackoffRatio is the ratio the limit is multiplied by on
+	// congestion
+	DefaultBackoffRatio = 0.9
+)
+
+// ConcurrencyLimiter limits the in-flight calls of a server, and sheds the
+// calls above the limit with codes.Unavailable
+// The limit adapts by AIMD: it grows by one for every unary call that
+// finishes within the latency target while the server is at least half
+// busy, and shrinks by the backoff ratio when calls are slower than the
+// target or exceed their deadline, at most once per latency target. Streams
+// take a slot while open but do not adapt the limit.
+type ConcurrencyLimiter struct {
+	mu           sync.Mutex
+	limit        float64
+	inflight     int
+	lastBackoff  time.Time
+	minLimit     float64
+	maxLimit     float64
+	target       time.Duration
+	backoffRatio float64
+
+	shed int64
+
+	health    *health.Health
+	busyAfter time.Duration
+	busy      bool
+	restore   health.ServiceState
+	shedSince time.Time
+	calmSince time.Time
+	stop      chan struct{}
+	once      sync.Once
+
+	now func() time.Time
+
+	log *logger.Logger
+}
+
+// ConcurrencyOption configures a ConcurrencyLimiter
+type ConcurrencyOption func(l *ConcurrencyLimiter)
+
+// WithConcurrencyLimits sets the initial, lowest and highest limits of
+// in-flight calls
+func WithConcurrencyLimits(initial, min, max int) ConcurrencyOption {
+	return func(l *ConcurrencyLimiter) {
+		l.limit = float64(initial)
+		l.minLimit = float64(min)
+		l.maxLimit = float64(max)
+	}
+}
+
+// WithLatencyTarget sets the latency above which a call is a congestion
+// signal
+func WithLatencyTarget(d time.Duration) ConcurrencyOption {
+	return func(l *ConcurrencyLimiter) {
+		l.target = d
+	}
+}
+
+// WithBackoffRatio sets the ratio (0 to 1) the limit is multiplied by on
+// congestion
+func WithBackoffRatio(ratio float64) ConcurrencyOption {
+	return func(l *ConcurrencyLimiter) {
+		l.backoffRatio = ratio
+	}
+}
+
+// WithBusyHealth sets h to health.ServiceStateBusy when calls have been shed
+// for d, and restores its state when no call has been shed for d
+// Balancers route away from a Busy server by its grpc health status, and the
+// registry when h is given to the service by service.WithHealth.
+func WithBusyHealth(h *health.Health, d time.Duration) ConcurrencyOption {
+	return func(l *ConcurrencyLimiter) {
+		l.health = h
+		l.busyAfter = d
+	}
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter
+// Close stops it from following the shedding with the health state.
+func NewConcurrencyLimiter(log *logger.Logger, opts ...ConcurrencyOption) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		limit:        DefaultInitialConcurrency,
+		minLimit:     DefaultMinConcurrency,
+		maxLimit:     DefaultMaxConcurrency,
+		target:       DefaultLatencyTarget,
+		backoffRatio: DefaultBackoffRatio,
+
+		stop: make(chan struct{}),
+		now:  time.Now,
+
+		log: log,
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.health != nil && l.busyAfter > 0 {
+		go l.watch()
+	}
+
+	return l
+}
+
+// Limit returns the current limit of in-flight calls
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
+
+// Close stops following the shedding with the health state
+func (l *ConcurrencyLimiter) Close() {
+	l.once.Do(func() {
+		close(l.stop)
+	})
+}
+
+// UnaryInterceptor is a grpc.UnaryServerInterceptor
+func (l *ConcurrencyLimiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	if l.acquire() == false {
+		return nil, l.shedError()
+	}
+
+	defer l.finish(l.now(), &err, true)
+
+	return handler(ctx, req)
+}
+
+// StreamInterceptor is a grpc.StreamServerInterceptor
+func (l *ConcurrencyLimiter) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	if l.acquire() == false {
+		return l.shedError()
+	}
+
+	defer l.finish(l.now(), &err, false)
+
+	return handler(srv, ss)
+}
+
+// finish releases the slot of a call started at startTime, it must be
+// deferred
+// A call that panics is released as failed, and the panic goes on to the
+// recovery interceptor.
+func (l *ConcurrencyLimiter) finish(startTime time.Time, err *error, sample bool) {
+	if r := recover(); r != nil {
+		l.release(l.now().Sub(startTime), status.Error(codes.Internal, "panic"), sample)
+		panic(r)
+	}
+
+	l.release(l.now().Sub(startTime), *err, sample)
+}
+
+// acquire takes a slot, it returns false when the server is at its limit
+func (l *ConcurrencyLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(l.inflight) >= math.Floor(l.limit) {
+		atomic.AddInt64(&l.shed, 1)
+		return false
+	}
+
+	l.inflight++
+
+	return true
+}
+
+// release frees a slot and adapts the limit to the latency of the call when
+// sample is true
+func (l *ConcurrencyLimiter) release(latency time.Duration, err error, sample bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inflight := l.inflight
+	l.inflight--
+
+	if sample == false {
+		return
+	}
+
+	if latency > l.target || status.Code(err) == codes.DeadlineExceeded {
+		now := l.now()
+		if now.Sub(l.lastBackoff) >= l.target {
+			l.limit = math.Max(l.minLimit, l.limit*l.backoffRatio)
+			l.lastBackoff = now
+		}
+		return
+	}
+
+	if float64(inflight)*2 >= l.limit {
+		l.limit = math.Min(l.maxLimit, l.limit+1)
+	}
+}
+
+// shedError returns the error of a shed call
+func (l *ConcurrencyLimiter) shedError() error {
+	return status.Error(codes.Unavailable, "server is overloaded")
+}
+
+// watch follows the shedding with the health state until Close
+func (l *ConcurrencyLimiter) watch() {
+	ticker := time.NewTicker(l.busyAfter / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.tick(l.now(), atomic.SwapInt64(&l.shed, 0) > 0)
+		}
+	}
+}
+
+// tick updates the health state with whether calls were shed since the last
+// tick
+func (l *ConcurrencyLimiter) tick(now time.Time, shed bool) {
+	if shed {
+		l.calmSince = time.Time{}
+		if l.shedSince.IsZero() {
+			l.shedSince = now
+		}
+	} else {
+		l.shedSince = time.Time{}
+		if l.calmSince.IsZero() {
+			l.calmSince = now
+		}
+	}
+
+	state := l.health.GetState()
+
+	switch {
+	case l.busy == false && l.shedSince.IsZero() == false && now.Sub(l.shedSince) >= l.busyAfter:
+		if state != health.ServiceStateOK && state != health.ServiceStateIdling {
+			return
+		}
+		l.busy = true
+		l.restore = state
+		l.log.Warnf("concurrency: shedding calls for %v at limit %d, the service is busy", now.Sub(l.shedSince), l.Limit())
+		l.health.GetChan() <- health.ServiceStateBusy
+
+	case l.busy && l.calmSince.IsZero() == false && now.Sub(l.calmSince) >= l.busyAfter:
+		l.busy = false
+		// the state may have been changed by someone else in between
+		if state != health.ServiceStateBusy {
+			return
+		}
+		l.log.Infof("concurrency: no call shed for %v, the service is %v again", now.Sub(l.calmSince), l.restore)
+		l.health.GetChan() <- l.restore
+	}
+}
@@ -0,0 +1,133 @@
+package grpchelper
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/health"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewConcurrencyLimiter(&logger.Logger{}, WithConcurrencyLimits(2, 1, 4), WithLatencyTarget(100*time.Millisecond))
+	l.now = func() time.Time { return now }
+
+	if l.acquire() == false || l.acquire() == false {
+		t.Fatal("a call within the limit was shed")
+	}
+	if l.acquire() {
+		t.Fatal("a call above the limit was not shed")
+	}
+
+	// fast calls grow the limit while the server is at least half busy
+	l.release(10*time.Millisecond, nil, true)
+	l.release(10*time.Millisecond, nil, true)
+	if l.Limit() != 3 {
+		t.Fatalf("limit = %d, want 3", l.Limit())
+	}
+
+	// slow calls shrink it once per latency target
+	l.acquire()
+	l.acquire()
+	l.release(time.Second, nil, true)
+	l.release(0, status.Error(codes.DeadlineExceeded, ""), true)
+	if math.Abs(l.limit-2.7) > 1e-9 {
+		t.Fatalf("limit = %v, want 2.7", l.limit)
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	l.acquire()
+	l.release(time.Second, nil, true)
+	if math.Abs(l.limit-2.43) > 1e-9 {
+		t.Fatalf("limit = %v, want 2.43", l.limit)
+	}
+}
+
+func TestConcurrencyLimiterBusyHealth(t *testing.T) {
+	h := health.NewHealth("127.0.0.1", 0, "/concurrency_test", &logger.Logger{})
+	h.GetChan() <- health.ServiceStateOK
+
+	l := NewConcurrencyLimiter(&logger.Logger{}, WithBusyHealth(h, time.Hour))
+	defer l.Close()
+
+	waitState := func(want health.ServiceState) {
+		for i := 0; i < 100 && h.GetState() != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if h.GetState() != want {
+			t.Fatalf("state = %v, want %v", h.GetState(), want)
+		}
+	}
+
+	now := time.Unix(1000, 0)
+	l.tick(now, true)
+	l.tick(now.Add(30*time.Minute), true)
+	waitState(health.ServiceStateOK)
+
+	l.tick(now.Add(time.Hour), true)
+	waitState(health.ServiceStateBusy)
+
+	l.tick(now.Add(2*time.Hour), false)
+	l.tick(now.Add(2*time.Hour+30*time.Minute), true)
+	l.tick(now.Add(3*time.Hour), false)
+	waitState(health.ServiceStateBusy)
+
+	l.tick(now.Add(4*time.Hour), false)
+	waitState(health.ServiceStateOK)
+}
+
+func TestConcurrencyLimiterPanic(t *testing.T) {
+	l := NewConcurrencyLimiter(&logger.Logger{}, WithConcurrencyLimits(1, 1, 1))
+
+	call := func(f func()) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = status.Error(codes.Internal, "recovered")
+			}
+		}()
+
+		info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+		_, err = l.UnaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			f()
+			return nil, nil
+		})
+		return err
+	}
+	stream := func(f func()) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = status.Error(codes.Internal, "recovered")
+			}
+		}()
+
+		info := &grpc.StreamServerInfo{FullMethod: "/account.Account/List"}
+		return l.StreamInterceptor(nil, &testServerStream{ctx: context.Background()}, info, func(srv interface{}, ss grpc.ServerStream) error {
+			f()
+			return nil
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := call(func() { panic("boom") }); status.Code(err) != codes.Internal {
+			t.Fatalf("the panic should go on to the recovery, got %v", err)
+		}
+		if err := stream(func() { panic("boom") }); status.Code(err) != codes.Internal {
+			t.Fatalf("the stream panic should go on to the recovery, got %v", err)
+		}
+	}
+
+	// the slots of the calls that panicked are released
+	if err := call(func() {}); err != nil {
+		t.Fatalf("a call after panics was shed: %v", err)
+	}
+	if err := stream(func() {}); err != nil {
+		t.Fatalf("a stream after panics was shed: %v", err)
+	}
+}
@@ -1,33 +1,268 @@
 package grpchelper
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
-	balancer "github.com/servicekit/servicekit-go/balancer/consul"
+	"github.com/servicekit/servicekit-go/balancer"
+	consul "github.com/servicekit/servicekit-go/balancer/consul"
+	"github.com/servicekit/servicekit-go/config"
 	"github.com/servicekit/servicekit-go/coordinator"
 	"github.com/servicekit/servicekit-go/logger"
 )
 
+// dialOptions describes the options of Dial
+type dialOptions struct {
+	caFile     string
+	serverName string
+	certFile   string
+	keyFile    string
+	tlsConfig  *tls.Config
+
+	insecure    bool
+	insecureENV config.ServiceENV
+
+	router       *balancer.Router
+	resolverOpts []consul.ResolverOption
+
+	outlierConfig   balancer.OutlierConfig
+	outliersEnabled bool
+
+	callOpts []grpc.CallOption
+	unary    []grpc.UnaryClientInterceptor
+	stream   []grpc.StreamClientInterceptor
+	grpcOpts []grpc.DialOption
+}
+
+// DialOption configures Dial
+type DialOption func(o *dialOptions)
+
+// WithTLSFromFile verifies the servers by the CA certificates in caFile
+// serverName overrides the server name of the certificates when it is not
+// empty. An empty caFile uses the system CA certificates.
+func WithTLSFromFile(caFile, serverName string) DialOption {
+	return func(o *dialOptions) {
+		o.caFile = caFile
+		o.serverName = serverName
+	}
+}
+
+// WithClientCert presents the certificate in certFile and keyFile to the
+// servers, for mutual TLS
+func WithClientCert(certFile, keyFile string) DialOption {
+	return func(o *dialOptions) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// WithTLSConfig uses cfg for TLS, WithTLSFromFile is ignored then
+func WithTLSConfig(cfg *tls.Config) DialOption {
+	return func(o *dialOptions) {
+		o.tlsConfig = cfg
+	}
+}
+
+// WithInsecure dials without TLS
+// It is only allowed when env is config.ServiceENVDev or
+// config.ServiceENVTesting, Dial fails otherwise.
+func WithInsecure(env config.ServiceENV) DialOption {
+	return func(o *dialOptions) {
+		o.insecure = true
+		o.insecureENV = env
+	}
+}
+
+// WithRouter routes the requests by router, e.g. by version or to canary
+// instances
+func WithRouter(router *balancer.Router) DialOption {
+	return func(o *dialOptions) {
+		o.router = router
+	}
+}
+
+// WithOutlierConfig configures the OutlierDetector of the backends
+func WithOutlierConfig(config balancer.OutlierConfig) DialOption {
+	return func(o *dialOptions) {
+		o.outlierConfig = config
+		o.outliersEnabled = true
+	}
+}
+
+// WithoutOutlierDetection never ejects the backends, e.g. for a service
+// with a single instance
+func WithoutOutlierDetection() DialOption {
+	return func(o *dialOptions) {
+		o.outliersEnabled = false
+	}
+}
+
+// WithResolverOptions configures the resolver, e.g. consul.WithFilter
+func WithResolverOptions(opts ...consul.ResolverOption) DialOption {
+	return func(o *dialOptions) {
+		o.resolverOpts = append(o.resolverOpts, opts...)
+	}
+}
+
+// WithDefaultCallOptions sets the default options of every call, e.g.
+// grpc.MaxCallRecvMsgSize
+func WithDefaultCallOptions(opts ...grpc.CallOption) DialOption {
+	return func(o *dialOptions) {
+		o.callOpts = append(o.callOpts, opts...)
+	}
+}
+
+// WithUnaryInterceptors chains unary client interceptors, the first one is
+// the outermost
+func WithUnaryInterceptors(interceptors ...grpc.UnaryClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.unary = append(o.unary, interceptors...)
+	}
+}
+
+// WithStreamInterceptors chains stream client interceptors, the first one
+// is the outermost
+func WithStreamInterceptors(interceptors ...grpc.StreamClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.stream = append(o.stream, interceptors...)
+	}
+}
+
+// WithDialOptions passes grpc dial options, e.g. grpc.WithKeepaliveParams
+// or grpc.WithUserAgent
+// The balancer, the transport security and the interceptors are set by
+// the other options and must not be passed here.
+func WithDialOptions(opts ...grpc.DialOption) DialOption {
+	return func(o *dialOptions) {
+		o.grpcOpts = append(o.grpcOpts, opts...)
+	}
+}
+
 // BalanceDial returns a client that dialed
-func BalanceDial(credPath, credDesc string, c coordinator.Coordinator, service string, tag string, log *logger.Logger) (*grpc.ClientConn, error) {
-	creds, err := credentials.NewClientTLSFromFile(credPath, credDesc)
+// The instances can be narrowed by resolver options, e.g. consul.WithFilter
+func BalanceDial(credPath, credDesc string, c coordinator.Coordinator, service string, tag string, log *logger.Logger, opts ...consul.ResolverOption) (*grpc.ClientConn, error) {
+	return Dial(c, service, tag, log, WithTLSFromFile(credPath, credDesc), WithResolverOptions(opts...))
+}
+
+// BalanceDialWithRouter returns a client that dialed
+// The requests are routed by router, e.g. by version or to canary instances
+func BalanceDialWithRouter(credPath, credDesc string, c coordinator.Coordinator, service string, tag string, router *balancer.Router, log *logger.Logger, opts ...consul.ResolverOption) (*grpc.ClientConn, error) {
+	return Dial(c, service, tag, log, WithTLSFromFile(credPath, credDesc), WithRouter(router), WithResolverOptions(opts...))
+}
+
+// Dial returns a client of service that dialed
+// Either TLS (WithTLSFromFile, WithTLSConfig) or WithInsecure is required.
+// Backends that keep failing or are slow are ejected for a while, see
+// balancer.OutlierDetector. Backends that register the standard health
+// service are skipped while NOT_SERVING, see balancer.HealthChecker
+func Dial(c coordinator.Coordinator, service string, tag string, log *logger.Logger, opts ...DialOption) (*grpc.ClientConn, error) {
+	o := newDialOptions(opts...)
+
+	security, err := o.transportSecurity()
 	if err != nil {
 		return nil, err
 	}
 
-	resolver, err := balancer.GetResolver(c, service, tag, log)
+	resolver, err := consul.GetResolver(c, service, tag, log, o.resolverOpts...)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := grpc.Dial(
-		"",
-		grpc.WithTransportCredentials(creds),
-		grpc.WithBalancer(grpc.RoundRobin(resolver)))
+	health := balancer.NewHealthChecker("")
+	rrOpts := []balancer.RoundRobinOption{balancer.WithHealthChecker(health)}
+
+	unary := append([]grpc.UnaryClientInterceptor{}, o.unary...)
+	stream := append([]grpc.StreamClientInterceptor{}, o.stream...)
+
+	if o.outliersEnabled {
+		outliers := balancer.NewOutlierDetector(o.outlierConfig)
+		rrOpts = append(rrOpts, balancer.WithOutlierDetector(outliers))
+
+		// The outlier interceptors are the innermost, so that every attempt
+		// of a retrying interceptor is attributed to its backend
+		unary = append(unary, outliers.UnaryClientInterceptor())
+		stream = append(stream, outliers.StreamClientInterceptor())
+	}
+
+	rr := balancer.NewRoundRobin(resolver, o.router, rrOpts...)
+
+	grpcOpts := append([]grpc.DialOption{}, o.grpcOpts...)
+	grpcOpts = append(grpcOpts,
+		security,
+		grpc.WithBalancer(rr),
+		grpc.WithUnaryInterceptor(UnaryClientChain(unary...)),
+		grpc.WithStreamInterceptor(StreamClientChain(stream...)))
+	if len(o.callOpts) > 0 {
+		grpcOpts = append(grpcOpts, grpc.WithDefaultCallOptions(o.callOpts...))
+	}
+
+	conn, err := grpc.Dial("", grpcOpts...)
 	if err != nil {
+		if r, ok := resolver.(*consul.Resolver); ok {
+			r.Close()
+		}
 		return nil, err
 	}
 
+	health.Start(conn)
+
 	return conn, nil
 }
+
+// newDialOptions returns the dialOptions configured by opts
+func newDialOptions(opts ...DialOption) *dialOptions {
+	o := &dialOptions{
+		outlierConfig:   balancer.DefaultOutlierConfig(),
+		outliersEnabled: true,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// transportSecurity returns the dial option of the transport security
+func (o *dialOptions) transportSecurity() (grpc.DialOption, error) {
+	if o.insecure {
+		if o.insecureENV != config.ServiceENVDev && o.insecureENV != config.ServiceENVTesting {
+			return nil, fmt.Errorf("grpchelper: insecure dial is not allowed in %q env", o.insecureENV)
+		}
+		return grpc.WithInsecure(), nil
+	}
+
+	var cfg *tls.Config
+	switch {
+	case o.tlsConfig != nil:
+		cfg = o.tlsConfig.Clone()
+	case o.caFile != "" || o.serverName != "" || o.certFile != "":
+		cfg = &tls.Config{ServerName: o.serverName}
+		if o.caFile != "" {
+			pem, err := ioutil.ReadFile(o.caFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if cfg.RootCAs.AppendCertsFromPEM(pem) == false {
+				return nil, fmt.Errorf("grpchelper: no certificate in %s", o.caFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("grpchelper: no transport security, use TLS or WithInsecure")
+	}
+
+	if o.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
@@ -0,0 +1,123 @@
+package grpchelper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/servicekit/servicekit-go/balancer"
+	"github.com/servicekit/servicekit-go/config"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func TestDialInsecureENV(t *testing.T) {
+	tests := []struct {
+		env     config.ServiceENV
+		allowed bool
+	}{
+		{config.ServiceENVDev, true},
+		{config.ServiceENVTesting, true},
+		{config.ServiceENVStaging, false},
+		{config.ServiceENVProd, false},
+		{"", false},
+		{"prod", false},
+	}
+
+	for _, tt := range tests {
+		o := &dialOptions{}
+		WithInsecure(tt.env)(o)
+
+		if _, err := o.transportSecurity(); (err == nil) != tt.allowed {
+			t.Errorf("insecure dial in %q env: err = %v, want allowed %v", tt.env, err, tt.allowed)
+		}
+
+		if tt.allowed == false {
+			// Dial fails before the coordinator is used
+			if _, err := Dial(nil, "account", "", &logger.Logger{}, WithInsecure(tt.env)); err == nil {
+				t.Errorf("Dial in %q env should fail", tt.env)
+			}
+		}
+	}
+
+	if _, err := Dial(nil, "account", "", &logger.Logger{}); err == nil {
+		t.Error("Dial without transport security should fail")
+	}
+}
+
+func TestDialOutlierOptions(t *testing.T) {
+	config := balancer.OutlierConfig{ConsecutiveErrors: 2, BaseEjectionTime: time.Minute}
+
+	tests := []struct {
+		name    string
+		opts    []DialOption
+		enabled bool
+		errors  int
+	}{
+		{"default", nil, true, balancer.DefaultConsecutiveErrors},
+		{"configured", []DialOption{WithOutlierConfig(config)}, true, 2},
+		{"disabled", []DialOption{WithoutOutlierDetection()}, false, balancer.DefaultConsecutiveErrors},
+		{"disabled then configured", []DialOption{WithoutOutlierDetection(), WithOutlierConfig(config)}, true, 2},
+	}
+
+	for _, tt := range tests {
+		o := newDialOptions(tt.opts...)
+		if o.outliersEnabled != tt.enabled || o.outlierConfig.ConsecutiveErrors != tt.errors {
+			t.Errorf("%s: outlier detection %v with %d errors, want %v with %d", tt.name, o.outliersEnabled, o.outlierConfig.ConsecutiveErrors, tt.enabled, tt.errors)
+		}
+	}
+}
+
+func TestUnaryClientChain(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			calls = append(calls, name+" before")
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			calls = append(calls, name+" after")
+			return err
+		}
+	}
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls = append(calls, "invoker")
+		return nil
+	}
+
+	chain := UnaryClientChain(interceptor("first"), interceptor("second"))
+	if err := chain(context.Background(), "/account.Account/Get", nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"first before", "second before", "invoker", "second after", "first after"}
+	if reflect.DeepEqual(calls, want) == false {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestStreamClientChain(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.StreamClientInterceptor {
+		return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			calls = append(calls, name+" before")
+			s, err := streamer(ctx, desc, cc, method, opts...)
+			calls = append(calls, name+" after")
+			return s, err
+		}
+	}
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		calls = append(calls, "streamer")
+		return nil, nil
+	}
+
+	chain := StreamClientChain(interceptor("first"), interceptor("second"))
+	if _, err := chain(context.Background(), &grpc.StreamDesc{}, nil, "/account.Account/List", streamer); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"first before", "second before", "streamer", "second after", "first after"}
+	if reflect.DeepEqual(calls, want) == false {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
@@ -0,0 +1,114 @@
+package grpchelper
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/apperror"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+// ErrorInterceptor maps the apperror.Error returned by handlers, or caused
+// by their errors, to statuses with details, and logs them
+// Errors of the caller, e.g. NotFound or InvalidArgument, are logged at
+// info level, transient errors at warn level and the others at error
+// level. The causes of errors are logged but not sent. Errors that are
+// neither statuses nor caused by an apperror.Error are left as they are.
+type ErrorInterceptor struct {
+	domain string
+
+	log *logger.Logger
+}
+
+// NewErrorInterceptor returns an ErrorInterceptor that sets the domain of
+// errors without one, e.g. to account.example.com
+func NewErrorInterceptor(log *logger.Logger, domain string) *ErrorInterceptor {
+	return &ErrorInterceptor{
+		domain: domain,
+
+		log: log,
+	}
+}
+
+// UnaryInterceptor is a grpc.UnaryServerInterceptor
+func (i *ErrorInterceptor) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return resp, i.mapError(ctx, info.FullMethod, err)
+	}
+
+	return resp, nil
+}
+
+// StreamInterceptor is a grpc.StreamServerInterceptor
+func (i *ErrorInterceptor) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	if err != nil {
+		return i.mapError(ss.Context(), info.FullMethod, err)
+	}
+
+	return nil
+}
+
+// mapError logs err and returns its status error
+func (i *ErrorInterceptor) mapError(ctx context.Context, method string, err error) error {
+	fields := map[string]interface{}{
+		"method":     method,
+		"request_id": requestIDFromContext(ctx),
+		"error":      err.Error(),
+	}
+
+	mapped := err
+	code := status.Code(err)
+	if e, ok := apperror.As(err); ok {
+		if e.Domain == "" && i.domain != "" {
+			c := *e
+			c.Domain = i.domain
+			e = &c
+		}
+		mapped = e.GRPCStatus().Err()
+		code = e.Code
+		if e.Reason != "" {
+			fields["reason"] = e.Reason
+		}
+	}
+	fields["code"] = code.String()
+
+	entry := i.log.WithFields(fields)
+	switch errorLevel(code) {
+	case "info":
+		entry.Info("grpc error")
+	case "warn":
+		entry.Warn("grpc error")
+	default:
+		entry.Error("grpc error")
+	}
+
+	return mapped
+}
+
+// errorLevel returns the log level of an error code
+func errorLevel(code codes.Code) string {
+	switch code {
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition,
+		codes.Aborted, codes.OutOfRange:
+		return "info"
+	case codes.DeadlineExceeded, codes.ResourceExhausted, codes.Unavailable:
+		return "warn"
+	}
+
+	return "error"
+}
+
+// ErrorUnaryClientInterceptor is a grpc.UnaryClientInterceptor that turns
+// the status errors of calls into apperror.Error, see apperror.FromError
+func ErrorUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+		return apperror.FromError(err)
+	}
+
+	return nil
+}
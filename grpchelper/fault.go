@@ -0,0 +1,397 @@
+package grpchelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/balancer"
+	"github.com/servicekit/servicekit-go/config"
+	"github.com/servicekit/servicekit-go/coordinator"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+// FaultPath is the path FaultInjector.Handler is usually mounted at
+const FaultPath = "/debug/faults"
+
+// faultENVs are the envs in which faults are injected by default
+var faultENVs = map[config.ServiceENV]bool{
+	config.ServiceENVTesting: true,
+	config.ServiceENVDev:     true,
+	config.ServiceENVStaging: true,
+}
+
+// FaultRule injects a delay, an error or both into a percentage of the calls
+// it matches
+// A call matches when its method matches one of Methods (see PolicyRule),
+// its metadata holds every header of Headers, and its caller is one of
+// Callers. Empty Headers or Callers match every call.
+type FaultRule struct {
+	Methods []string          `json:"methods"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Callers []string          `json:"callers,omitempty"`
+	// Percentage of the matched calls (0 to 100) that get the fault
+	Percentage float64 `json:"percentage"`
+	// DelayMs delays the calls before they are handled or sent
+	DelayMs int `json:"delay_ms,omitempty"`
+	// Code fails the calls after the delay when it is not OK, as a name
+	// ("UNAVAILABLE") or a number
+	Code    codes.Code `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// ParseFaultRules returns the rules of a JSON array, e.g.
+//     [{"methods": ["/account.Account/*"], "percentage": 10, "delay_ms": 500},
+//      {"methods": ["*"], "headers": {"x-chaos": "1"}, "percentage": 100, "code": "UNAVAILABLE"}]
+func ParseFaultRules(data []byte) ([]FaultRule, error) {
+	var rules []FaultRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if len(rule.Methods) == 0 {
+			return nil, fmt.Errorf("fault: rule %d has no methods", i)
+		}
+		if rule.Percentage < 0 || rule.Percentage > 100 {
+			return nil, fmt.Errorf("fault: rule %d has an invalid percentage %v", i, rule.Percentage)
+		}
+		if rule.DelayMs < 0 {
+			return nil, fmt.Errorf("fault: rule %d has a negative delay", i)
+		}
+	}
+
+	return rules, nil
+}
+
+// match returns true when the rule applies to a call
+func (rule *FaultRule) match(method string, md metadata.MD, caller string) bool {
+	matched := false
+	for _, m := range rule.Methods {
+		if matchMethodPattern(m, method) {
+			matched = true
+			break
+		}
+	}
+	if matched == false {
+		return false
+	}
+
+	for k, v := range rule.Headers {
+		values := md.Get(k)
+		if len(values) == 0 || values[0] != v {
+			return false
+		}
+	}
+
+	if len(rule.Callers) == 0 {
+		return true
+	}
+	for _, c := range rule.Callers {
+		if c == caller {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FaultInjector injects the faults of its rules into server and client
+// calls, to test retries, failover and timeouts
+// It is enabled in the testing, dev and staging envs only, and in any other
+// env, production or unknown, when WithFaultsInProduction is given. There
+// are no rules by default; they are changed at runtime by
+// SetRules, by Handler, or by WatchKV from the coordinator KV.
+type FaultInjector struct {
+	rules   atomic.Value
+	enabled bool
+
+	callerKey CallerKeyFunc
+	rand      func() float64
+
+	mu   sync.Mutex
+	stop chan struct{}
+
+	log *logger.Logger
+}
+
+// FaultOption configures a FaultInjector
+type FaultOption func(f *FaultInjector)
+
+// WithFaultsInProduction enables fault injection whatever the env, including
+// config.ServiceENVProd
+func WithFaultsInProduction() FaultOption {
+	return func(f *FaultInjector) {
+		f.enabled = true
+	}
+}
+
+// WithFaultCallerKey identifies the callers of FaultRule.Callers by
+// callerKey, by default the principal and then the peer IP
+func WithFaultCallerKey(callerKey CallerKeyFunc) FaultOption {
+	return func(f *FaultInjector) {
+		f.callerKey = callerKey
+	}
+}
+
+// NewFaultInjector returns a FaultInjector for a service running in env
+func NewFaultInjector(env config.ServiceENV, log *logger.Logger, opts ...FaultOption) *FaultInjector {
+	f := &FaultInjector{
+		enabled:   faultENVs[env],
+		callerKey: CallerByPrincipal,
+		rand:      rand.Float64,
+
+		log: log,
+	}
+	f.rules.Store([]FaultRule(nil))
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if f.enabled == false {
+		log.Infof("fault: fault injection is disabled in %s", env)
+	}
+
+	return f
+}
+
+// Enabled returns true when faults are injected
+func (f *FaultInjector) Enabled() bool {
+	return f.enabled
+}
+
+// SetRules replaces the rules
+func (f *FaultInjector) SetRules(rules []FaultRule) {
+	f.rules.Store(rules)
+
+	if f.enabled {
+		f.log.Warnf("fault: %d fault rules set", len(rules))
+	}
+}
+
+// GetRules returns the current rules
+func (f *FaultInjector) GetRules() []FaultRule {
+	return f.rules.Load().([]FaultRule)
+}
+
+// Handler returns a http handler that shows the rules on GET and replaces
+// them by the JSON array of the body on PUT or POST
+// The handler does not authenticate requests. It is not mounted by default;
+// mount it on a dedicated mux served on an admin listener that only
+// operators reach, never on http.DefaultServeMux, which health serves on
+// the public health port:
+//     mux := http.NewServeMux()
+//     mux.Handle(grpchelper.FaultPath, f.Handler())
+//     go http.ListenAndServe("127.0.0.1:8081", mux)
+func (f *FaultInjector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(f.GetRules())
+
+		case http.MethodPut, http.MethodPost:
+			if f.enabled == false {
+				http.Error(w, "fault injection is disabled", http.StatusForbidden)
+				return
+			}
+
+			data, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rules, err := ParseFaultRules(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.SetRules(rules)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// WatchKV replaces the rules by the JSON array at key of kv whenever it
+// changes, checking every interval until Close
+// A missing key removes every rule.
+func (f *FaultInjector) WatchKV(kv coordinator.KVCoordinator, key string, interval time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop != nil {
+		close(f.stop)
+	}
+	stop := make(chan struct{})
+	f.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var lastIndex uint64
+		for {
+			lastIndex = f.reloadKV(kv, key, lastIndex)
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// reloadKV replaces the rules when the modify index of key is not
+// lastIndex, and returns the index of the rules in use
+func (f *FaultInjector) reloadKV(kv coordinator.KVCoordinator, key string, lastIndex uint64) uint64 {
+	value, index, err := kv.GetKV(context.Background(), key)
+	if err != nil {
+		f.log.Warnf("fault: get rules %s: %v", key, err)
+		return lastIndex
+	}
+	if index == lastIndex {
+		return lastIndex
+	}
+
+	var rules []FaultRule
+	if value != nil {
+		rules, err = ParseFaultRules(value)
+		if err != nil {
+			f.log.Errorf("fault: parse rules %s, the current rules are kept: %v", key, err)
+			return index
+		}
+	}
+	f.SetRules(rules)
+
+	return index
+}
+
+// Close stops watching the KV
+func (f *FaultInjector) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+// UnaryServerInterceptor is a grpc.UnaryServerInterceptor
+func (f *FaultInjector) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if err := f.inject(ctx, info.FullMethod, md); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor is a grpc.StreamServerInterceptor
+func (f *FaultInjector) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	if err := f.inject(ss.Context(), info.FullMethod, md); err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
+
+// UnaryClientInterceptor is a grpc.UnaryClientInterceptor
+// Headers are matched against the outgoing metadata. The probes of a
+// balancer.HealthChecker get no fault.
+func (f *FaultInjector) UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if balancer.IsHealthProbe(ctx) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if err := f.inject(ctx, method, md); err != nil {
+		return err
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// StreamClientInterceptor is a grpc.StreamClientInterceptor
+func (f *FaultInjector) StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if balancer.IsHealthProbe(ctx) {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if err := f.inject(ctx, method, md); err != nil {
+		return nil, err
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// inject applies the first rule that matches a call, it returns the
+// injected error
+func (f *FaultInjector) inject(ctx context.Context, method string, md metadata.MD) error {
+	if f.enabled == false {
+		return nil
+	}
+
+	rules := f.GetRules()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	caller := f.callerKey(ctx)
+	if caller == "" {
+		caller = CallerByPeerIP(ctx)
+	}
+
+	for _, rule := range rules {
+		if rule.match(method, md, caller) == false {
+			continue
+		}
+		if f.rand()*100 >= rule.Percentage {
+			return nil
+		}
+
+		f.log.Debugf("fault: inject into %s. RequestID: %v, delay: %dms, code: %v", method, requestIDFromContext(ctx), rule.DelayMs, rule.Code)
+
+		if rule.DelayMs > 0 {
+			t := time.NewTimer(time.Duration(rule.DelayMs) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return status.FromContextError(ctx.Err()).Err()
+			case <-t.C:
+			}
+		}
+
+		if rule.Code != codes.OK {
+			msg := rule.Message
+			if msg == "" {
+				msg = "injected fault"
+			}
+			return status.Error(rule.Code, msg)
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
@@ -0,0 +1,112 @@
+package grpchelper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/config"
+	coordinator "github.com/servicekit/servicekit-go/coordinator/consul"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func TestFaultInjector(t *testing.T) {
+	rules, err := ParseFaultRules([]byte(`[
+		{"methods": ["/account.Account/*"], "headers": {"X-Chaos": "1"}, "percentage": 50, "code": "UNAVAILABLE"},
+		{"methods": ["/order.Order/Get"], "callers": ["jwt:alice"], "percentage": 100, "code": 8}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFaultInjector(config.ServiceENVTesting, &logger.Logger{})
+	f.SetRules(rules)
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	call := func(ctx context.Context, method string, r float64) codes.Code {
+		f.rand = func() float64 { return r }
+		_, err := f.UnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return status.Code(err)
+	}
+
+	chaos := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-chaos", "1"))
+	alice := ContextWithPrincipal(context.Background(), &Principal{ID: "alice", Method: AuthMethodJWT})
+
+	tests := []struct {
+		ctx    context.Context
+		method string
+		rand   float64
+		code   codes.Code
+	}{
+		{chaos, "/account.Account/Get", 0.1, codes.Unavailable},
+		{chaos, "/account.Account/Get", 0.6, codes.OK},
+		{context.Background(), "/account.Account/Get", 0.1, codes.OK},
+		{alice, "/order.Order/Get", 0.99, codes.ResourceExhausted},
+		{context.Background(), "/order.Order/Get", 0.1, codes.OK},
+	}
+
+	for _, tt := range tests {
+		if code := call(tt.ctx, tt.method, tt.rand); code != tt.code {
+			t.Errorf("%s with rand %v = %v, want %v", tt.method, tt.rand, code, tt.code)
+		}
+	}
+
+	for _, env := range []config.ServiceENV{config.ServiceENVProd, "", "prod"} {
+		f := NewFaultInjector(env, &logger.Logger{})
+		f.SetRules(rules)
+		f.rand = func() float64 { return 0 }
+		if _, err := f.UnaryServerInterceptor(chaos, nil, &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}, handler); err != nil {
+			t.Errorf("a fault was injected in env %q: %v", env, err)
+		}
+	}
+
+	if NewFaultInjector("", &logger.Logger{}, WithFaultsInProduction()).Enabled() == false {
+		t.Error("WithFaultsInProduction should enable faults")
+	}
+}
+
+func TestFaultInjectorHandler(t *testing.T) {
+	f := NewFaultInjector(config.ServiceENVDev, &logger.Logger{})
+
+	w := httptest.NewRecorder()
+	f.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, FaultPath, strings.NewReader(`[{"methods": ["*"], "percentage": 100, "delay_ms": 10}]`)))
+	if w.Code != http.StatusNoContent || len(f.GetRules()) != 1 {
+		t.Fatalf("PUT = %d with %d rules", w.Code, len(f.GetRules()))
+	}
+
+	w = httptest.NewRecorder()
+	f.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, FaultPath, strings.NewReader(`[{"percentage": 100}]`)))
+	if w.Code != http.StatusBadRequest || len(f.GetRules()) != 1 {
+		t.Fatalf("invalid PUT = %d with %d rules", w.Code, len(f.GetRules()))
+	}
+
+	prod := NewFaultInjector(config.ServiceENVProd, &logger.Logger{})
+	w = httptest.NewRecorder()
+	prod.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, FaultPath, strings.NewReader(`[]`)))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("PUT in production = %d, want 403", w.Code)
+	}
+}
+
+func TestFaultInjectorReloadKV(t *testing.T) {
+	tc := &coordinator.TestConsul{}
+	f := NewFaultInjector(config.ServiceENVDev, &logger.Logger{})
+
+	tc.PutKV(context.Background(), "faults", []byte(`[{"methods": ["*"], "percentage": 100}]`))
+	index := f.reloadKV(tc, "faults", 0)
+	if len(f.GetRules()) != 1 {
+		t.Fatalf("%d rules loaded, want 1", len(f.GetRules()))
+	}
+
+	tc.PutKV(context.Background(), "faults", []byte(`not json`))
+	if f.reloadKV(tc, "faults", index) == index || len(f.GetRules()) != 1 {
+		t.Fatal("invalid rules replaced the current ones")
+	}
+}
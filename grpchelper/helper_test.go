@@ -0,0 +1,128 @@
+package grpchelper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	coordinator "github.com/servicekit/servicekit-go/coordinator/consul"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/trace"
+)
+
+// testLog is a logger output whose JSON lines are read back by tests
+type testLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// newTestLogger returns a Logger that writes to a testLog
+func newTestLogger() (*logger.Logger, *testLog) {
+	l := &testLog{}
+
+	return logger.NewWriterLogger(l), l
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.Write(p)
+}
+
+// entries returns the entries written so far
+func (l *testLog) entries(t *testing.T) []map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []map[string]interface{}
+	s := bufio.NewScanner(bytes.NewReader(l.buf.Bytes()))
+	for s.Scan() {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid log line %s: %v", s.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// testServerStream is a grpc.ServerStream whose received messages are given
+// by recv
+type testServerStream struct {
+	grpc.ServerStream
+
+	ctx  context.Context
+	recv func(m interface{}) error
+	sent []interface{}
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testServerStream) RecvMsg(m interface{}) error {
+	if s.recv == nil {
+		return io.EOF
+	}
+
+	return s.recv(m)
+}
+
+func (s *testServerStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m)
+
+	return nil
+}
+
+var (
+	traceOnce sync.Once
+	testTr    *trace.Trace
+	traceErr  error
+)
+
+// testTrace returns the Trace of the tests
+// A Trace mounts its handlers on http.DefaultServeMux, so that only one is
+// made per test binary.
+func testTrace(t *testing.T) *trace.Trace {
+	traceOnce.Do(func() {
+		testTr, traceErr = trace.NewTrace(&coordinator.TestConsul{}, "trace_1", "trace", nil, "127.0.0.1", 0, time.Minute, &logger.Logger{})
+	})
+	if traceErr != nil {
+		t.Fatal(traceErr)
+	}
+
+	return testTr
+}
+
+// counterValue returns the value of c
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+// histogramCount returns the count of the observations of o
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetHistogram().GetSampleCount()
+}
@@ -1,8 +1,6 @@
 package grpchelper
 
 import (
-	"reflect"
-	"runtime"
 	"time"
 
 	"golang.org/x/net/context"
@@ -15,6 +13,9 @@ import (
 type requestIDKey struct{}
 
 // UnaryServerChan returns a UnaryServerInterceptor
+// With several interceptors, the request ID is put into the context and its
+// outgoing metadata; the incoming metadata, e.g. credentials, is not
+// forwarded to the services the handler calls.
 func UnaryServerChan(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
 	switch len(interceptors) {
 	case 0:
@@ -42,7 +43,7 @@ func UnaryServerChan(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServ
 				chain = buildChain(interceptors[i], chain)
 			}
 			requestID := requestid.HandleRequestIDChain(ctx)
-			ctx = requestid.UpdateContextWithRequestID(ctx, requestID)
+			ctx = requestid.ContextWithRequestID(ctx, requestID)
 			return chain(ctx, req)
 		}
 	}
@@ -50,43 +51,79 @@ func UnaryServerChan(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServ
 
 // CommonUnaryServerInterceptor describe a server interceptor
 type CommonUnaryServerInterceptor struct {
+	serverInterceptorOptions
+
 	log *logger.Logger
 }
 
 // NewCommonUnaryServerInterceptor returns a CommonUnaryServerInterceptor
-func NewCommonUnaryServerInterceptor(log *logger.Logger) *CommonUnaryServerInterceptor {
+func NewCommonUnaryServerInterceptor(log *logger.Logger, opts ...ServerInterceptorOption) *CommonUnaryServerInterceptor {
 	return &CommonUnaryServerInterceptor{
+		serverInterceptorOptions: newServerInterceptorOptions(opts, log),
+
 		log: log,
 	}
 }
 
 // RecoverInterceptor can recover a panic
+// The call fails with codes.Internal and the request ID then, see
+// WithRecoveryHandler to return another error.
 func (i *CommonUnaryServerInterceptor) RecoverInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			stack := make([]byte, 1024*8)
-			stack = stack[:runtime.Stack(stack, false)]
-			i.log.Errorf("panic grpc invoke: %s, err=%v, stack:\n%s", info.FullMethod, r, string(stack))
+			resp, err = nil, i.recovered(ctx, i.log, info.FullMethod, r)
 		}
 	}()
 
 	return handler(ctx, req)
 }
 
-// TraceInterceptor trace common info
+// TraceInterceptor writes an access log of every call
+// The fields are method, code, latency_ms, request_id, peer, user_agent,
+// req_size and resp_size, see WithSampleRate and WithSlowThreshold.
 func (i *CommonUnaryServerInterceptor) TraceInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 	startTime := time.Now()
 
-	rid := reflect.ValueOf(req).Elem().FieldByName("RequestID")
-
-	i.log.Infof("GRPC Request: %v start. RequestID: %v", info.FullMethod, rid)
-
 	resp, err = handler(ctx, req)
 
-	doneTime := time.Now().Sub(startTime)
-
-	i.log.Infof("GRPC Request: %v done. RequestID: %v, time: %v", info.FullMethod, rid, doneTime.String())
+	i.accessLog(ctx, i.log, info.FullMethod, startTime, err, map[string]interface{}{
+		"req_size":  messageSize(req),
+		"resp_size": messageSize(resp),
+	})
 
 	return resp, err
+}
+
+// UnaryClientChain returns a UnaryClientInterceptor that chains interceptors,
+// the first one is the outermost
+func UnaryClientChain(interceptors ...grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		buildChain := func(current grpc.UnaryClientInterceptor, next grpc.UnaryInvoker) grpc.UnaryInvoker {
+			return func(currentCtx context.Context, currentMethod string, currentReq, currentReply interface{}, currentConn *grpc.ClientConn, currentOpts ...grpc.CallOption) error {
+				return current(currentCtx, currentMethod, currentReq, currentReply, currentConn, next, currentOpts...)
+			}
+		}
+		chain := invoker
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			chain = buildChain(interceptors[i], chain)
+		}
+		return chain(ctx, method, req, reply, cc, opts...)
+	}
+}
 
+// StreamClientChain returns a StreamClientInterceptor that chains
+// interceptors, the first one is the outermost
+func StreamClientChain(interceptors ...grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		buildChain := func(current grpc.StreamClientInterceptor, next grpc.Streamer) grpc.Streamer {
+			return func(currentCtx context.Context, currentDesc *grpc.StreamDesc, currentConn *grpc.ClientConn, currentMethod string, currentOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return current(currentCtx, currentDesc, currentConn, currentMethod, next, currentOpts...)
+			}
+		}
+		chain := streamer
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			chain = buildChain(interceptors[i], chain)
+		}
+		return chain(ctx, desc, cc, method, opts...)
+	}
 }
@@ -0,0 +1,47 @@
+package grpchelper
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+// incomingCredentials returns a context whose incoming metadata holds a
+// request ID and credentials
+func incomingCredentials() context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		requestid.RequestIDKey, "rid-1",
+		"authorization", "Bearer secret",
+		"x-api-key", "secret"))
+}
+
+// checkOutgoing checks that the outgoing metadata of ctx holds the request
+// ID only
+func checkOutgoing(t *testing.T, ctx context.Context) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, key := range []string{"authorization", "x-api-key"} {
+		if values := md.Get(key); len(values) > 0 {
+			t.Errorf("%s is forwarded: %v", key, values)
+		}
+	}
+	if values := md.Get(requestid.RequestIDKey); len(values) != 1 || values[0] != requestid.GetRequestIDFromContext(ctx) {
+		t.Errorf("outgoing request IDs = %v, want [%s]", values, requestid.GetRequestIDFromContext(ctx))
+	}
+}
+
+func TestUnaryServerChanOutgoingMetadata(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	pass := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(ctx, req)
+	}
+
+	chain := UnaryServerChan(pass, pass)
+	chain(incomingCredentials(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		checkOutgoing(t, ctx)
+		return nil, nil
+	})
+}
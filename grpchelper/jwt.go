@@ -0,0 +1,414 @@
+package grpchelper
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the JWT algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// JWTKeySet holds the keys that verify JWTs by key ID
+// A key is a *rsa.PublicKey (RS256, RS384, RS512, PS256, PS384, PS512), a
+// *ecdsa.PublicKey (ES256, ES384, ES512) or a []byte secret (HS256, HS384,
+// HS512).
+type JWTKeySet map[string]interface{}
+
+// jwk is a JSON Web Key of RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS returns the keys of a JWKS document, e.g.
+//     {"keys": [{"kty": "RSA", "kid": "2018-09", "n": "...", "e": "AQAB"}]}
+// Keys whose use is not sig are skipped.
+func ParseJWKS(data []byte) (JWTKeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(JWTKeySet, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// LoadJWKS returns the keys of the JWKS file at path
+func LoadJWKS(path string) (JWTKeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(data)
+}
+
+// publicKey returns the key of k
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if e.BitLen() > 31 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if curve.IsOnCurve(x, y) == false {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, errors.New("empty secret")
+		}
+		return secret, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// JWTAuthenticator authenticates the bearer JWT of the authorization
+// metadata
+// The signature is verified by the key of the kid header; a token without
+// kid is verified by the only key of the set. exp and nbf are checked when
+// present, iss and aud when configured. The principal ID is the sub claim.
+type JWTAuthenticator struct {
+	keys     JWTKeySet
+	issuer   string
+	audience string
+	leeway   time.Duration
+
+	now func() time.Time
+}
+
+// JWTOption configures a JWTAuthenticator
+type JWTOption func(a *JWTAuthenticator)
+
+// WithIssuer only accepts tokens whose iss claim is issuer
+func WithIssuer(issuer string) JWTOption {
+	return func(a *JWTAuthenticator) {
+		a.issuer = issuer
+	}
+}
+
+// WithAudience only accepts tokens whose aud claim holds audience
+func WithAudience(audience string) JWTOption {
+	return func(a *JWTAuthenticator) {
+		a.audience = audience
+	}
+}
+
+// WithLeeway tolerates clock skew of d when checking exp and nbf
+func WithLeeway(d time.Duration) JWTOption {
+	return func(a *JWTAuthenticator) {
+		a.leeway = d
+	}
+}
+
+// NewJWTAuthenticator returns a JWTAuthenticator that verifies tokens by keys
+func NewJWTAuthenticator(keys JWTKeySet, opts ...JWTOption) *JWTAuthenticator {
+	a := &JWTAuthenticator{
+		keys: keys,
+		now:  time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// Authenticate implements Authenticator
+func (a *JWTAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return a.Verify(strings.TrimSpace(v[7:]))
+		}
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// Verify returns the principal of a compact serialized JWT
+func (a *JWTAuthenticator) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("jwt: malformed header: %v", err)
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed signature: %v", err)
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("jwt: malformed claims: %v", err)
+	}
+
+	if err := a.validate(claims); err != nil {
+		return nil, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("jwt: missing sub claim")
+	}
+
+	return &Principal{ID: sub, Method: AuthMethodJWT, Claims: claims}, nil
+}
+
+// key returns the key of kid
+func (a *JWTAuthenticator) key(kid string) (interface{}, error) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+
+	key, ok := a.keys[kid]
+	if ok == false {
+		return nil, fmt.Errorf("jwt: unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// validate checks the registered claims
+func (a *JWTAuthenticator) validate(claims map[string]interface{}) error {
+	now := a.now()
+
+	if exp, ok := claims["exp"]; ok {
+		t, ok := exp.(float64)
+		if ok == false {
+			return errors.New("jwt: invalid exp claim")
+		}
+		if now.After(time.Unix(int64(t), 0).Add(a.leeway)) {
+			return errors.New("jwt: token is expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := nbf.(float64)
+		if ok == false {
+			return errors.New("jwt: invalid nbf claim")
+		}
+		if now.Add(a.leeway).Before(time.Unix(int64(t), 0)) {
+			return errors.New("jwt: token is not valid yet")
+		}
+	}
+
+	if a.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.issuer {
+			return fmt.Errorf("jwt: invalid issuer %q", iss)
+		}
+	}
+
+	if a.audience != "" && hasAudience(claims["aud"], a.audience) == false {
+		return errors.New("jwt: invalid audience")
+	}
+
+	return nil
+}
+
+// hasAudience returns true when the aud claim holds audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment into v
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// ecdsaCurves are the curves of the ECDSA algorithms of RFC 7518
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// verifySignature verifies sig of signed by alg and key
+// The algorithm must match the type of key, so that a token cannot choose
+// e.g. HS256 with a public RSA key as secret, and the curve of an ECDSA key.
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("jwt: unsupported algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("jwt: unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil {
+			return nil
+		}
+
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if ok && rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+			return nil
+		}
+
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if ok && k.Curve.Params().Name != ecdsaCurves[alg] {
+			ok = false
+		}
+		size := 0
+		if ok {
+			size = (k.Curve.Params().BitSize + 7) / 8
+		}
+		if ok && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+
+	case "HS":
+		k, ok := key.([]byte)
+		if ok {
+			mac := hmac.New(hash.New, k)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return nil
+			}
+		}
+
+	default:
+		return fmt.Errorf("jwt: unsupported algorithm %q", alg)
+	}
+
+	return errors.New("jwt: invalid signature")
+}
@@ -0,0 +1,210 @@
+package grpchelper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/servicekit/servicekit-go/trace"
+)
+
+const (
+	// ServerStartedCounter is the name of the counter of started calls
+	ServerStartedCounter = "grpc_server_started_total"
+	// ServerHandledCounter is the name of the counter of finished calls
+	ServerHandledCounter = "grpc_server_handled_total"
+	// ServerHandlingHistogram is the name of the histogram of call latency
+	ServerHandlingHistogram = "grpc_server_handling_seconds"
+	// ServerMsgReceivedCounter is the name of the counter of received messages
+	ServerMsgReceivedCounter = "grpc_server_msg_received_total"
+	// ServerMsgSentCounter is the name of the counter of sent messages
+	ServerMsgSentCounter = "grpc_server_msg_sent_total"
+
+	// grpc_type label values
+	typeUnary        = "unary"
+	typeClientStream = "client_stream"
+	typeServerStream = "server_stream"
+	typeBidiStream   = "bidi_stream"
+)
+
+// The labels of the call metrics of the server and the client; they must not
+// change, dashboards and alerts depend on them
+var (
+	// serviceMethodLabels are the labels of the metrics of any call
+	serviceMethodLabels = []string{"grpc_service", "grpc_method"}
+	// methodLabels are the labels of every call metric
+	methodLabels = append([]string{"grpc_type"}, serviceMethodLabels...)
+	// methodCodeLabels are the labels of the metrics of finished calls
+	methodCodeLabels = append(append([]string{}, methodLabels...), "grpc_code")
+)
+
+// ServerMetrics records the RED metrics of a server: started and handled
+// calls by code, latency, and received and sent messages per method
+// The names and labels follow go-grpc-prometheus, so that the dashboards
+// built for it work.
+type ServerMetrics struct {
+	started  *prometheus.CounterVec
+	handled  *prometheus.CounterVec
+	handling *prometheus.HistogramVec
+	received *prometheus.CounterVec
+	sent     *prometheus.CounterVec
+}
+
+// ServerRequestMetricsVecs returns the vectors recorded by ServerMetrics
+func ServerRequestMetricsVecs() []trace.PrometheusVec {
+	return []trace.PrometheusVec{
+		&trace.PrometheusCounter{
+			Name:   ServerStartedCounter,
+			Help:   "Total number of RPCs started on the server.",
+			Labels: methodLabels,
+		},
+		&trace.PrometheusCounter{
+			Name:   ServerHandledCounter,
+			Help:   "Total number of RPCs completed on the server, regardless of success or failure.",
+			Labels: methodCodeLabels,
+		},
+		&trace.PrometheusHistogram{
+			Name:   ServerHandlingHistogram,
+			Help:   "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+			Labels: methodLabels,
+		},
+		&trace.PrometheusCounter{
+			Name:   ServerMsgReceivedCounter,
+			Help:   "Total number of RPC stream messages received on the server.",
+			Labels: methodLabels,
+		},
+		&trace.PrometheusCounter{
+			Name:   ServerMsgSentCounter,
+			Help:   "Total number of gRPC stream messages sent by the server.",
+			Labels: methodLabels,
+		},
+	}
+}
+
+// NewServerMetrics returns a ServerMetrics whose vectors are registered to t
+func NewServerMetrics(t *trace.Trace) (*ServerMetrics, error) {
+	if t == nil {
+		return nil, fmt.Errorf("grpchelper: server metrics need a trace")
+	}
+
+	if err := t.Register(ServerRequestMetricsVecs()...); err != nil {
+		return nil, err
+	}
+
+	m := &ServerMetrics{
+		started:  t.GetCounter(ServerStartedCounter),
+		handled:  t.GetCounter(ServerHandledCounter),
+		handling: t.GetHistogram(ServerHandlingHistogram),
+		received: t.GetCounter(ServerMsgReceivedCounter),
+		sent:     t.GetCounter(ServerMsgSentCounter),
+	}
+	if m.started == nil || m.handled == nil || m.handling == nil || m.received == nil || m.sent == nil {
+		return nil, fmt.Errorf("grpchelper: server metrics are registered with other types")
+	}
+
+	return m, nil
+}
+
+// UnaryInterceptor is a grpc.UnaryServerInterceptor
+func (m *ServerMetrics) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	labels := methodLabelValues(typeUnary, info.FullMethod)
+
+	m.started.WithLabelValues(labels...).Inc()
+	m.received.WithLabelValues(labels...).Inc()
+
+	startTime := time.Now()
+	resp, err := handler(ctx, req)
+
+	if err == nil {
+		m.sent.WithLabelValues(labels...).Inc()
+	}
+	m.done(labels, startTime, err)
+
+	return resp, err
+}
+
+// StreamInterceptor is a grpc.StreamServerInterceptor
+func (m *ServerMetrics) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	labels := methodLabelValues(streamType(info), info.FullMethod)
+
+	m.started.WithLabelValues(labels...).Inc()
+
+	startTime := time.Now()
+	err := handler(srv, &metricsServerStream{
+		ServerStream: ss,
+		received:     m.received.WithLabelValues(labels...),
+		sent:         m.sent.WithLabelValues(labels...),
+	})
+
+	m.done(labels, startTime, err)
+
+	return err
+}
+
+// done records a finished call
+func (m *ServerMetrics) done(labels []string, startTime time.Time, err error) {
+	m.handled.WithLabelValues(append(labels, status.Code(err).String())...).Inc()
+	m.handling.WithLabelValues(labels...).Observe(time.Now().Sub(startTime).Seconds())
+}
+
+// metricsServerStream counts the messages of a stream
+type metricsServerStream struct {
+	grpc.ServerStream
+
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+func (s *metricsServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+	}
+
+	return err
+}
+
+func (s *metricsServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+	}
+
+	return err
+}
+
+// streamType returns the grpc_type of a stream
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return typeBidiStream
+	case info.IsClientStream:
+		return typeClientStream
+	}
+
+	return typeServerStream
+}
+
+// methodLabelValues returns the values of methodLabels, fullMethod is
+// /package.Service/Method
+func methodLabelValues(grpcType, fullMethod string) []string {
+	return append([]string{grpcType}, serviceMethodLabelValues(fullMethod)...)
+}
+
+// serviceMethodLabelValues returns the values of serviceMethodLabels,
+// fullMethod is /package.Service/Method
+func serviceMethodLabelValues(fullMethod string) []string {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	service, method := "unknown", "unknown"
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		service, method = fullMethod[:i], fullMethod[i+1:]
+	}
+
+	return []string{service, method}
+}
@@ -0,0 +1,147 @@
+package grpchelper
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func TestMethodLabelValues(t *testing.T) {
+	tests := []struct {
+		method string
+		values []string
+	}{
+		{"/account.Account/Get", []string{"account.Account", "Get"}},
+		{"account.Account/Get", []string{"account.Account", "Get"}},
+		{"Get", []string{"unknown", "unknown"}},
+	}
+
+	for _, tt := range tests {
+		if values := serviceMethodLabelValues(tt.method); reflect.DeepEqual(values, tt.values) == false {
+			t.Errorf("serviceMethodLabelValues(%s) = %v, want %v", tt.method, values, tt.values)
+		}
+
+		values := methodLabelValues(typeUnary, tt.method)
+		if want := append([]string{typeUnary}, tt.values...); reflect.DeepEqual(values, want) == false {
+			t.Errorf("methodLabelValues(%s) = %v, want %v", tt.method, values, want)
+		}
+	}
+
+	// dashboards depend on the labels
+	if want := []string{"grpc_type", "grpc_service", "grpc_method"}; reflect.DeepEqual(methodLabels, want) == false {
+		t.Errorf("methodLabels = %v, want %v", methodLabels, want)
+	}
+	if want := []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}; reflect.DeepEqual(methodCodeLabels, want) == false {
+		t.Errorf("methodCodeLabels = %v, want %v", methodCodeLabels, want)
+	}
+}
+
+func TestServerMetricsUnary(t *testing.T) {
+	m, err := NewServerMetrics(testTrace(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Unary/Get"}
+	labels := []string{typeUnary, "metrics.Unary", "Get"}
+
+	m.UnaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	m.UnaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+
+	tests := []struct {
+		name  string
+		value float64
+		want  float64
+	}{
+		{"started", counterValue(t, m.started.WithLabelValues(labels...)), 2},
+		{"received", counterValue(t, m.received.WithLabelValues(labels...)), 2},
+		{"sent", counterValue(t, m.sent.WithLabelValues(labels...)), 1},
+		{"handled OK", counterValue(t, m.handled.WithLabelValues(append(labels, "OK")...)), 1},
+		{"handled NotFound", counterValue(t, m.handled.WithLabelValues(append(labels, "NotFound")...)), 1},
+		{"handling", float64(histogramCount(t, m.handling.WithLabelValues(labels...))), 2},
+	}
+
+	for _, tt := range tests {
+		if tt.value != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.value, tt.want)
+		}
+	}
+}
+
+func TestServerMetricsStream(t *testing.T) {
+	m, err := NewServerMetrics(testTrace(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &grpc.StreamServerInfo{FullMethod: "/metrics.Stream/Chat", IsClientStream: true, IsServerStream: true}
+	labels := []string{typeBidiStream, "metrics.Stream", "Chat"}
+
+	received := 0
+	ss := &testServerStream{ctx: context.Background(), recv: func(msg interface{}) error {
+		if received == 2 {
+			return io.EOF
+		}
+		received++
+		return nil
+	}}
+
+	err = m.StreamInterceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		for {
+			if err := stream.RecvMsg(nil); err != nil {
+				break
+			}
+		}
+		return stream.SendMsg("done")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value float64
+		want  float64
+	}{
+		{"started", counterValue(t, m.started.WithLabelValues(labels...)), 1},
+		{"received", counterValue(t, m.received.WithLabelValues(labels...)), 2},
+		{"sent", counterValue(t, m.sent.WithLabelValues(labels...)), 1},
+		{"handled OK", counterValue(t, m.handled.WithLabelValues(append(labels, "OK")...)), 1},
+		{"handling", float64(histogramCount(t, m.handling.WithLabelValues(labels...))), 1},
+	}
+
+	for _, tt := range tests {
+		if tt.value != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.value, tt.want)
+		}
+	}
+}
+
+func TestServerPanicCounter(t *testing.T) {
+	tr := testTrace(t)
+	i := NewCommonUnaryServerInterceptor(&logger.Logger{}, WithTrace(tr))
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Panic/Get"}
+	i.RecoverInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+
+	c := tr.GetCounter(ServerPanicCounter)
+	if c == nil {
+		t.Fatal("the panic counter is not registered")
+	}
+	if v := counterValue(t, c.WithLabelValues("metrics.Panic", "Get")); v != 1 {
+		t.Errorf("%s = %v, want 1", ServerPanicCounter, v)
+	}
+}
@@ -0,0 +1,481 @@
+package grpchelper
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/coordinator"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+const (
+	// RetryAfterHeader is the header metadata that tells rate limited callers
+	// how many seconds to wait
+	RetryAfterHeader = "retry-after"
+
+	// DefaultRateLimitPrefix is the KV prefix of the buckets shared by
+	// replicas
+	DefaultRateLimitPrefix = "servicekit/ratelimit/"
+
+	// DefaultRateLimitSweepInterval is the interval between two sweeps of
+	// the idle buckets of the KV
+	DefaultRateLimitSweepInterval = 10 * time.Minute
+
+	// maxLocalBuckets bounds the buckets kept in memory, the least recently
+	// used one is dropped above it
+	maxLocalBuckets = 10000
+	// maxSwapRetries is the number of compare-and-swap conflicts tolerated
+	// before a shared bucket falls back to the local one
+	maxSwapRetries = 3
+)
+
+// RateLimit is a token bucket that refills Rate tokens per second up to Burst
+type RateLimit struct {
+	// Method is a full method (/account.Account/Get), a service pattern
+	// (/account.Account/*) or * for every method, each matched method has
+	// its own bucket
+	Method string  `json:"method"`
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+	// PerCaller gives each caller its own bucket, otherwise the callers of
+	// the method share one
+	PerCaller bool `json:"per_caller,omitempty"`
+}
+
+// ParseRateLimits returns the limits of a JSON array, e.g.
+//     [{"method": "/account.Account/Search", "rate": 10, "burst": 20, "per_caller": true},
+//      {"method": "*", "rate": 500, "burst": 1000}]
+func ParseRateLimits(data []byte) ([]RateLimit, error) {
+	var limits []RateLimit
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil, err
+	}
+
+	for i, limit := range limits {
+		if limit.Method == "" {
+			return nil, fmt.Errorf("ratelimit: limit %d has no method", i)
+		}
+		if limit.Rate <= 0 {
+			return nil, fmt.Errorf("ratelimit: limit %d has an invalid rate %v", i, limit.Rate)
+		}
+		if limit.Burst <= 0 {
+			return nil, fmt.Errorf("ratelimit: limit %d has an invalid burst %d", i, limit.Burst)
+		}
+	}
+
+	return limits, nil
+}
+
+// matchMethod returns true when the limit applies to method
+func (l *RateLimit) matchMethod(method string) bool {
+	return matchMethodPattern(l.Method, method)
+}
+
+// CallerKeyFunc returns the key that identifies the caller of a call, an
+// empty key falls back to the peer IP
+type CallerKeyFunc func(ctx context.Context) string
+
+// CallerByPrincipal identifies callers by the principal of AuthInterceptor
+func CallerByPrincipal(ctx context.Context) string {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		return p.Method + ":" + p.ID
+	}
+
+	return ""
+}
+
+// CallerByPeerIP identifies callers by their IP
+func CallerByPeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if ok == false || p.Addr == nil {
+		return ""
+	}
+
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// CallerByHeader identifies callers by a metadata header, e.g. x-client-id
+func CallerByHeader(header string) CallerKeyFunc {
+	header = strings.ToLower(header)
+
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(header); len(v) > 0 {
+			return v[0]
+		}
+
+		return ""
+	}
+}
+
+// RateLimitStore holds the token buckets of a RateLimiter
+type RateLimitStore interface {
+	// Take takes a token from the bucket of key, it returns false and the
+	// time until the next token when the bucket is empty
+	Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// tokenBucket is the state of a bucket
+type tokenBucket struct {
+	Tokens float64 `json:"tokens"`
+	Last   int64   `json:"last"`
+	// Rate and Burst are those of the last take, so that an idle bucket is
+	// known to be full again
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// full returns true when b refilled up to its burst at now
+func (b *tokenBucket) full(now time.Time) bool {
+	idle := time.Duration(now.UnixNano() - b.Last)
+
+	return b.Tokens+idle.Seconds()*b.Rate >= float64(b.Burst)
+}
+
+// take refills b until now and takes a token from it
+func (b *tokenBucket) take(now time.Time, limit RateLimit) (bool, time.Duration) {
+	b.Rate, b.Burst = limit.Rate, limit.Burst
+
+	elapsed := float64(now.UnixNano()-b.Last) / float64(time.Second)
+	if elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+elapsed*limit.Rate)
+		b.Last = now.UnixNano()
+	}
+
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+
+	if limit.Rate <= 0 {
+		return false, time.Second
+	}
+
+	return false, time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+}
+
+// localRateLimitStore holds buckets in memory, so every replica enforces its
+// own limits
+// It keeps maxBuckets buckets at most, so that callers that choose their
+// key, e.g. by header, cannot grow it without bound.
+type localRateLimitStore struct {
+	mu         sync.Mutex
+	buckets    map[string]*list.Element
+	lru        *list.List
+	maxBuckets int
+
+	now func() time.Time
+}
+
+// localBucket is a bucket of the LRU list
+type localBucket struct {
+	key string
+	tokenBucket
+}
+
+func newLocalRateLimitStore() *localRateLimitStore {
+	return &localRateLimitStore{
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxBuckets: maxLocalBuckets,
+		now:        time.Now,
+	}
+}
+
+// Take implements RateLimitStore
+func (s *localRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	e, ok := s.buckets[key]
+	if ok {
+		s.lru.MoveToFront(e)
+	} else {
+		for len(s.buckets) >= s.maxBuckets {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*localBucket).key)
+		}
+		e = s.lru.PushFront(&localBucket{key: key, tokenBucket: tokenBucket{Tokens: float64(limit.Burst), Last: now.UnixNano()}})
+		s.buckets[key] = e
+	}
+
+	allowed, wait := e.Value.(*localBucket).take(now, limit)
+
+	return allowed, wait, nil
+}
+
+// kvRateLimitStore holds buckets in the KV store of a coordinator, so that
+// the replicas of a service share their limits
+type kvRateLimitStore struct {
+	kv            coordinator.KVCoordinator
+	prefix        string
+	sweepInterval time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+
+	now func() time.Time
+	log *logger.Logger
+}
+
+// NewKVRateLimitStore returns a RateLimitStore whose buckets are shared by
+// every replica through kv, under prefix
+// Every call reads and swaps its bucket, so it is meant for limits of a few
+// hundred calls per second at most. Bucket keys are hashed, so that caller
+// keys never shape KV paths, and the buckets that refilled are deleted every
+// DefaultRateLimitSweepInterval.
+func NewKVRateLimitStore(kv coordinator.KVCoordinator, prefix string, log *logger.Logger) RateLimitStore {
+	if prefix == "" {
+		prefix = DefaultRateLimitPrefix
+	}
+
+	return &kvRateLimitStore{
+		kv:            kv,
+		prefix:        prefix,
+		sweepInterval: DefaultRateLimitSweepInterval,
+
+		now: time.Now,
+		log: log,
+	}
+}
+
+// Take implements RateLimitStore
+func (s *kvRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	digest := sha256.Sum256([]byte(key))
+	key = s.prefix + hex.EncodeToString(digest[:])
+
+	if s.sweepDue() {
+		go s.sweep(context.Background())
+	}
+
+	for i := 0; i < maxSwapRetries; i++ {
+		value, index, err := s.kv.GetKV(ctx, key)
+		if err != nil {
+			return false, 0, err
+		}
+
+		now := s.now()
+		b := &tokenBucket{Tokens: float64(limit.Burst), Last: now.UnixNano()}
+		if value != nil {
+			if err := json.Unmarshal(value, b); err != nil {
+				return false, 0, err
+			}
+		}
+
+		allowed, wait := b.take(now, limit)
+
+		value, err = json.Marshal(b)
+		if err != nil {
+			return false, 0, err
+		}
+
+		ok, err := s.kv.CompareAndSwapKV(ctx, key, value, index)
+		if err != nil {
+			return false, 0, err
+		}
+		if ok {
+			return allowed, wait, nil
+		}
+	}
+
+	return false, 0, errors.New("ratelimit: too many conflicts on " + key)
+}
+
+// sweepDue returns true when the idle buckets should be swept, at most once
+// per sweep interval
+func (s *kvRateLimitStore) sweepDue() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) < s.sweepInterval {
+		return false
+	}
+	s.lastSweep = now
+
+	return true
+}
+
+// sweep deletes the buckets that are full again, a bucket taken from in
+// between is kept
+func (s *kvRateLimitStore) sweep(ctx context.Context) {
+	pairs, err := s.kv.ListKV(ctx, s.prefix)
+	if err != nil {
+		s.log.Warnf("ratelimit: list buckets: %v", err)
+		return
+	}
+
+	now := s.now()
+	for _, pair := range pairs {
+		b := &tokenBucket{}
+		if err := json.Unmarshal(pair.Value, b); err == nil && b.full(now) == false {
+			continue
+		}
+		if _, err := s.kv.CompareAndDeleteKV(ctx, pair.Key, pair.ModifyIndex); err != nil {
+			s.log.Warnf("ratelimit: delete bucket %s: %v", pair.Key, err)
+		}
+	}
+}
+
+// RateLimiter rejects the calls above the RateLimit of their method with
+// codes.ResourceExhausted
+// The first limit that matches a method applies. Rejections carry the
+// retry-after header and a RetryInfo detail. When the shared store fails,
+// the limits are enforced by each replica until it recovers.
+type RateLimiter struct {
+	limits    []RateLimit
+	callerKey CallerKeyFunc
+	store     RateLimitStore
+	local     *localRateLimitStore
+
+	log *logger.Logger
+}
+
+// RateLimitOption configures a RateLimiter
+type RateLimitOption func(l *RateLimiter)
+
+// WithCallerKey identifies callers by f, by default the principal and then
+// the peer IP
+func WithCallerKey(f CallerKeyFunc) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.callerKey = f
+	}
+}
+
+// WithRateLimitStore shares the buckets through store, e.g. a store of
+// NewKVRateLimitStore
+func WithRateLimitStore(store RateLimitStore) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.store = store
+	}
+}
+
+// NewRateLimiter returns a RateLimiter that enforces limits
+func NewRateLimiter(log *logger.Logger, limits []RateLimit, opts ...RateLimitOption) *RateLimiter {
+	l := &RateLimiter{
+		limits:    limits,
+		callerKey: CallerByPrincipal,
+		local:     newLocalRateLimitStore(),
+
+		log: log,
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.store == nil {
+		l.store = l.local
+	}
+
+	return l
+}
+
+// UnaryInterceptor is a grpc.UnaryServerInterceptor
+func (l *RateLimiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if wait, ok := l.allow(ctx, info.FullMethod); ok == false {
+		grpc.SetHeader(ctx, retryAfter(wait))
+		return nil, l.exhausted(ctx, info.FullMethod, wait)
+	}
+
+	return handler(ctx, req)
+}
+
+// StreamInterceptor is a grpc.StreamServerInterceptor
+func (l *RateLimiter) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if wait, ok := l.allow(ss.Context(), info.FullMethod); ok == false {
+		ss.SetHeader(retryAfter(wait))
+		return l.exhausted(ss.Context(), info.FullMethod, wait)
+	}
+
+	return handler(srv, ss)
+}
+
+// allow takes a token for the call, it returns false and the time until the
+// next token when the call is above its limit
+func (l *RateLimiter) allow(ctx context.Context, method string) (time.Duration, bool) {
+	limit, ok := l.limit(method)
+	if ok == false {
+		return 0, true
+	}
+
+	key := method
+	if limit.PerCaller {
+		caller := l.callerKey(ctx)
+		if caller == "" {
+			caller = CallerByPeerIP(ctx)
+		}
+		key += "/" + caller
+	}
+
+	allowed, wait, err := l.store.Take(ctx, key, limit)
+	if err != nil && l.store != RateLimitStore(l.local) {
+		l.log.Warnf("ratelimit: shared store failed, limiting locally: %v", err)
+		allowed, wait, err = l.local.Take(ctx, key, limit)
+	}
+	if err != nil {
+		return 0, true
+	}
+
+	return wait, allowed
+}
+
+// limit returns the first limit that matches method
+func (l *RateLimiter) limit(method string) (RateLimit, bool) {
+	for _, limit := range l.limits {
+		if limit.matchMethod(method) {
+			return limit, true
+		}
+	}
+
+	return RateLimit{}, false
+}
+
+// exhausted returns the error of a rejected call
+func (l *RateLimiter) exhausted(ctx context.Context, method string, wait time.Duration) error {
+	l.log.Warnf("ratelimit: %s rejected. RequestID: %v, retry after: %v", method, requestIDFromContext(ctx), wait)
+
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	if ds, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(wait)}); err == nil {
+		st = ds
+	}
+
+	return st.Err()
+}
+
+// retryAfter returns the retry-after header of wait, in whole seconds
+func retryAfter(wait time.Duration) metadata.MD {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return metadata.Pairs(RetryAfterHeader, strconv.FormatInt(seconds, 10))
+}
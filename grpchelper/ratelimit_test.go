@@ -0,0 +1,186 @@
+package grpchelper
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	coordinator "github.com/servicekit/servicekit-go/coordinator/consul"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+func TestLocalRateLimitStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newLocalRateLimitStore()
+	s.now = func() time.Time { return now }
+
+	limit := RateLimit{Method: "*", Rate: 2, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := s.Take(context.Background(), "a", limit); ok == false {
+			t.Fatalf("take %d was rejected within the burst", i)
+		}
+	}
+
+	ok, wait, _ := s.Take(context.Background(), "a", limit)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("take above the burst = %v, %v, want false, 500ms", ok, wait)
+	}
+
+	if ok, _, _ := s.Take(context.Background(), "b", limit); ok == false {
+		t.Fatal("another key shares the bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _, _ := s.Take(context.Background(), "a", limit); ok == false {
+		t.Fatal("the bucket was not refilled")
+	}
+}
+
+func TestLocalRateLimitStoreCap(t *testing.T) {
+	s := newLocalRateLimitStore()
+	s.maxBuckets = 3
+
+	limit := RateLimit{Method: "*", Rate: 0.001, Burst: 1}
+	for _, key := range []string{"a", "b", "c", "a", "d", "e"} {
+		s.Take(context.Background(), key, limit)
+	}
+
+	if len(s.buckets) != 3 || s.lru.Len() != 3 {
+		t.Fatalf("%d buckets kept, want 3", len(s.buckets))
+	}
+	for _, key := range []string{"a", "d", "e"} {
+		if _, ok := s.buckets[key]; ok == false {
+			t.Errorf("recently used bucket %s was dropped", key)
+		}
+	}
+}
+
+func TestKVRateLimitStore(t *testing.T) {
+	tc := &coordinator.TestConsul{}
+	now := time.Unix(1000, 0)
+
+	// two replicas share the bucket
+	var stores []*kvRateLimitStore
+	for i := 0; i < 2; i++ {
+		s := NewKVRateLimitStore(tc, "", &logger.Logger{}).(*kvRateLimitStore)
+		s.now = func() time.Time { return now }
+		s.sweepInterval = time.Hour
+		s.lastSweep = now
+		stores = append(stores, s)
+	}
+
+	limit := RateLimit{Method: "/account.Account/Get", Rate: 1, Burst: 3}
+	allowed := 0
+	for i := 0; i < 6; i++ {
+		ok, _, err := stores[i%2].Take(context.Background(), limit.Method, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			allowed++
+		}
+	}
+
+	if allowed != 3 {
+		t.Fatalf("allowed %d calls, want 3", allowed)
+	}
+
+	stores[0].Take(context.Background(), limit.Method+"/../../x", limit)
+	pairs, _ := tc.ListKV(context.Background(), "")
+	if len(pairs) != 2 {
+		t.Fatalf("%d buckets stored, want 2", len(pairs))
+	}
+	for _, pair := range pairs {
+		if strings.ContainsAny(strings.TrimPrefix(pair.Key, DefaultRateLimitPrefix), "/.") {
+			t.Errorf("bucket key %s is not hashed", pair.Key)
+		}
+	}
+
+	// the bucket of the caller refilled, the other one did not
+	now = now.Add(2 * time.Second)
+	stores[0].sweep(context.Background())
+	if pairs, _ := tc.ListKV(context.Background(), ""); len(pairs) != 1 {
+		t.Fatalf("%d buckets left after the sweep, want 1", len(pairs))
+	}
+}
+
+func TestRateLimiterUnaryInterceptor(t *testing.T) {
+	l := NewRateLimiter(&logger.Logger{}, []RateLimit{
+		{Method: "/account.Account/*", Rate: 0.1, Burst: 1, PerCaller: true},
+	})
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	alice := ContextWithPrincipal(context.Background(), &Principal{ID: "alice", Method: AuthMethodJWT})
+	bob := ContextWithPrincipal(context.Background(), &Principal{ID: "bob", Method: AuthMethodJWT})
+
+	if _, err := l.UnaryInterceptor(alice, nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := l.UnaryInterceptor(alice, nil, info, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("code = %v, want ResourceExhausted", status.Code(err))
+	}
+	if len(status.Convert(err).Details()) != 1 {
+		t.Fatal("the error carries no RetryInfo")
+	}
+
+	if _, err := l.UnaryInterceptor(bob, nil, info, handler); err != nil {
+		t.Fatalf("another caller was limited: %v", err)
+	}
+
+	other := &grpc.UnaryServerInfo{FullMethod: "/order.Order/Get"}
+	for i := 0; i < 3; i++ {
+		if _, err := l.UnaryInterceptor(alice, nil, other, handler); err != nil {
+			t.Fatalf("a method without limit was limited: %v", err)
+		}
+	}
+}
+
+func TestRateLimiterPerMethod(t *testing.T) {
+	l := NewRateLimiter(&logger.Logger{}, []RateLimit{
+		{Method: "/account.Account/*", Rate: 0.1, Burst: 1},
+	})
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	get := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	list := &grpc.UnaryServerInfo{FullMethod: "/account.Account/List"}
+
+	if _, err := l.UnaryInterceptor(context.Background(), nil, get, handler); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.UnaryInterceptor(context.Background(), nil, list, handler); err != nil {
+		t.Fatalf("the bucket of Get limited List: %v", err)
+	}
+	if _, err := l.UnaryInterceptor(context.Background(), nil, get, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("code = %v, want ResourceExhausted", status.Code(err))
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{`[{"method": "/account.Account/Search", "rate": 10, "burst": 20, "per_caller": true}, {"method": "*", "rate": 0.5, "burst": 1}]`, true},
+		{`[{"rate": 10, "burst": 20}]`, false},
+		{`[{"method": "*", "rate": 0, "burst": 20}]`, false},
+		{`[{"method": "*", "rate": -1, "burst": 20}]`, false},
+		{`[{"method": "*", "rate": 10}]`, false},
+		{`[{"method": "*", "rate": 10, "burst": -1}]`, false},
+		{`{"method": "*"}`, false},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseRateLimits([]byte(tt.data)); (err == nil) != tt.valid {
+			t.Errorf("ParseRateLimits(%s) = %v, want valid %v", tt.data, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package grpchelper
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/config"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+	"github.com/servicekit/servicekit-go/trace"
+)
+
+// ServerPanicCounter is the name of the counter of recovered panics
+const ServerPanicCounter = "grpc_server_panics_total"
+
+// PanicMetricsVecs returns the vectors recorded by the recover interceptors
+func PanicMetricsVecs() []trace.PrometheusVec {
+	return []trace.PrometheusVec{
+		&trace.PrometheusCounter{
+			Name:   ServerPanicCounter,
+			Help:   "Total number of panics recovered by the server.",
+			Labels: serviceMethodLabels,
+		},
+	}
+}
+
+// RecoveryHandler returns the error of a call that panicked with p
+// stack is the stack trace of the panic.
+type RecoveryHandler func(ctx context.Context, method string, p interface{}, stack []byte) error
+
+// serverInterceptorOptions describes the options of the server interceptors
+type serverInterceptorOptions struct {
+	env             config.ServiceENV
+	trace           *trace.Trace
+	recoveryHandler RecoveryHandler
+
+	sampleRate    float64
+	slowThreshold time.Duration
+}
+
+// ServerInterceptorOption configures CommonUnaryServerInterceptor and
+// CommonStreamServerInterceptor
+type ServerInterceptorOption func(o *serverInterceptorOptions)
+
+// WithENV sets the env of the service
+// In dev and testing env, the stack trace of a panic is attached to the
+// status as errdetails.DebugInfo.
+func WithENV(env config.ServiceENV) ServerInterceptorOption {
+	return func(o *serverInterceptorOptions) {
+		o.env = env
+	}
+}
+
+// WithTrace records the metrics of PanicMetricsVecs to t, they are
+// registered to t
+func WithTrace(t *trace.Trace) ServerInterceptorOption {
+	return func(o *serverInterceptorOptions) {
+		o.trace = t
+	}
+}
+
+// WithRecoveryHandler returns the error of h for calls that panic, instead
+// of codes.Internal
+func WithRecoveryHandler(h RecoveryHandler) ServerInterceptorOption {
+	return func(o *serverInterceptorOptions) {
+		o.recoveryHandler = h
+	}
+}
+
+// newServerInterceptorOptions returns the options of opts
+// The metrics are not recorded when they cannot be registered to the trace.
+func newServerInterceptorOptions(opts []ServerInterceptorOption, log *logger.Logger) serverInterceptorOptions {
+	o := serverInterceptorOptions{
+		sampleRate: 1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.trace != nil {
+		if err := o.trace.Register(PanicMetricsVecs()...); err != nil {
+			log.Errorf("grpchelper: register server metrics: %v", err)
+			o.trace = nil
+		}
+	}
+
+	return o
+}
+
+// recovered logs the panic p of a call, counts it and returns the error of
+// the call
+func (o *serverInterceptorOptions) recovered(ctx context.Context, log *logger.Logger, method string, p interface{}) error {
+	stack := make([]byte, 1024*8)
+	stack = stack[:runtime.Stack(stack, false)]
+
+	rid := requestIDFromContext(ctx)
+	log.Errorf("panic grpc invoke: %s, RequestID: %v, err=%v, stack:\n%s", method, rid, p, string(stack))
+
+	if o.trace != nil {
+		if c := o.trace.GetCounter(ServerPanicCounter); c != nil {
+			c.WithLabelValues(serviceMethodLabelValues(method)...).Inc()
+		}
+	}
+
+	if o.recoveryHandler != nil {
+		return o.recoveryHandler(ctx, method, p, stack)
+	}
+
+	// The panic value may hold internal data, it is not sent to clients
+	st := status.New(codes.Internal, fmt.Sprintf("internal error, request ID: %s", rid))
+	if o.env == config.ServiceENVDev || o.env == config.ServiceENVTesting {
+		detailed, err := st.WithDetails(&errdetails.DebugInfo{
+			StackEntries: strings.Split(strings.TrimSpace(string(stack)), "\n"),
+			Detail:       fmt.Sprint(p),
+		})
+		if err == nil {
+			st = detailed
+		}
+	}
+
+	return st.Err()
+}
+
+// requestIDFromContext returns the request ID put into ctx by the server
+// chains, or the one in incoming metadata
+func requestIDFromContext(ctx context.Context) string {
+	if rid, ok := ctx.Value(requestIDKey{}).(string); ok && rid != "" {
+		return rid
+	}
+
+	return requestid.GetRequestIDFromContext(ctx)
+}
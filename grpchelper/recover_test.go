@@ -0,0 +1,43 @@
+package grpchelper
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/config"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+func TestRecoverInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Get"}
+	panicking := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("secret")
+	}
+	ctx := requestid.UpdateContextWithRequestID(context.Background(), "rid-1")
+
+	for _, env := range []config.ServiceENV{config.ServiceENVProd, config.ServiceENVDev} {
+		i := NewCommonUnaryServerInterceptor(&logger.Logger{}, WithENV(env))
+
+		resp, err := i.RecoverInterceptor(ctx, nil, info, panicking)
+		if resp != nil {
+			t.Errorf("resp = %v, want nil", resp)
+		}
+
+		st := status.Convert(err)
+		if st.Code() != codes.Internal {
+			t.Errorf("code = %v, want Internal", st.Code())
+		}
+		if strings.Contains(st.Message(), "rid-1") == false || strings.Contains(st.Message(), "secret") {
+			t.Errorf("message = %q, want the request ID only", st.Message())
+		}
+		if details := len(st.Details()); (env == config.ServiceENVDev) != (details == 1) {
+			t.Errorf("%s env: %d details", env, details)
+		}
+	}
+}
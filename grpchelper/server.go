@@ -0,0 +1,412 @@
+package grpchelper
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/servicekit/servicekit-go/config"
+	"github.com/servicekit/servicekit-go/health"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+const (
+	// DefaultMaxRecvMsgSize is the default largest message a server receives
+	DefaultMaxRecvMsgSize = 4 << 20
+	// DefaultMaxSendMsgSize is the default largest message a server sends
+	DefaultMaxSendMsgSize = 4 << 20
+	// DefaultStopTimeout is the default time a server waits for calls to
+	// finish when it stops
+	DefaultStopTimeout = 30 * time.Second
+)
+
+// DefaultKeepaliveParams are the default keepalive parameters of a server
+var DefaultKeepaliveParams = keepalive.ServerParameters{
+	MaxConnectionIdle: 15 * time.Minute,
+	Time:              time.Minute,
+	Timeout:           20 * time.Second,
+}
+
+// DefaultKeepalivePolicy is the default keepalive enforcement policy of a
+// server, clients that ping more often are disconnected
+var DefaultKeepalivePolicy = keepalive.EnforcementPolicy{
+	MinTime:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// ErrServerStarted is returned when a Server is served twice
+var ErrServerStarted = errors.New("grpchelper: server already started")
+
+// Server is a service.GRPCServer that serves a grpc.Server with the
+// standard interceptors, the grpc health service and server reflection
+// The unary chain is request ID, recovery, access log, metrics (when a
+// trace is given by WithTrace) and the interceptors of
+// WithServerUnaryInterceptors; the stream chain is the same with the
+// failed streams log. The server stops gracefully when the context of
+// Serve is done.
+type Server struct {
+	register func(s *grpc.Server)
+
+	interceptorOptions []ServerInterceptorOption
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	grpcOptions        []grpc.ServerOption
+	tlsConfig          *tls.Config
+	keepaliveParams    keepalive.ServerParameters
+	keepalivePolicy    keepalive.EnforcementPolicy
+	maxRecvMsgSize     int
+	maxSendMsgSize     int
+	stopTimeout        time.Duration
+	reflection         bool
+
+	plaintext    bool
+	plaintextENV config.ServiceENV
+
+	health     *health.Health
+	grpcHealth *grpchealth.Server
+
+	mu     sync.Mutex
+	server *grpc.Server
+	ready  chan struct{}
+
+	log *logger.Logger
+}
+
+// ServerOption configures a Server
+type ServerOption func(s *Server)
+
+// WithServerInterceptorOptions configures the standard interceptors, e.g.
+// by WithENV, WithTrace or WithSlowThreshold
+func WithServerInterceptorOptions(opts ...ServerInterceptorOption) ServerOption {
+	return func(s *Server) {
+		s.interceptorOptions = append(s.interceptorOptions, opts...)
+	}
+}
+
+// WithServerUnaryInterceptors appends interceptors to the unary chain, e.g.
+// auth or rate limiting
+func WithServerUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) ServerOption {
+	return func(s *Server) {
+		s.unaryInterceptors = append(s.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithServerStreamInterceptors appends interceptors to the stream chain
+func WithServerStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) ServerOption {
+	return func(s *Server) {
+		s.streamInterceptors = append(s.streamInterceptors, interceptors...)
+	}
+}
+
+// WithServerTLSConfig uses config for TLS, with the certificate of the pem
+// and key of Serve, e.g. to verify client certificates:
+//     &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+func WithServerTLSConfig(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithKeepalive replaces DefaultKeepaliveParams and DefaultKeepalivePolicy
+func WithKeepalive(params keepalive.ServerParameters, policy keepalive.EnforcementPolicy) ServerOption {
+	return func(s *Server) {
+		s.keepaliveParams = params
+		s.keepalivePolicy = policy
+	}
+}
+
+// WithMaxMsgSize sets the largest messages the server receives and sends
+func WithMaxMsgSize(recv, send int) ServerOption {
+	return func(s *Server) {
+		s.maxRecvMsgSize = recv
+		s.maxSendMsgSize = send
+	}
+}
+
+// WithStopTimeout sets the time the server waits for calls to finish when
+// it stops, the remaining calls are cancelled then
+func WithStopTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.stopTimeout = d
+	}
+}
+
+// WithHealthServer serves the grpc health service of h, so that it follows
+// the state of the service
+// By default the health service is SERVING while the server serves.
+func WithHealthServer(h *health.Health) ServerOption {
+	return func(s *Server) {
+		s.health = h
+	}
+}
+
+// WithoutReflection does not register server reflection
+func WithoutReflection() ServerOption {
+	return func(s *Server) {
+		s.reflection = false
+	}
+}
+
+// WithPlaintext serves without TLS when the pem and key of Serve are empty
+// It is only allowed when env is config.ServiceENVDev or
+// config.ServiceENVTesting, Serve fails otherwise.
+func WithPlaintext(env config.ServiceENV) ServerOption {
+	return func(s *Server) {
+		s.plaintext = true
+		s.plaintextENV = env
+	}
+}
+
+// WithGRPCServerOptions appends options of the grpc.Server
+func WithGRPCServerOptions(opts ...grpc.ServerOption) ServerOption {
+	return func(s *Server) {
+		s.grpcOptions = append(s.grpcOptions, opts...)
+	}
+}
+
+// NewServer returns a Server whose services are registered by register
+// register is called by Serve once the grpc.Server is built, e.g.
+//     func(s *grpc.Server) { pb.RegisterAccountServer(s, account) }
+func NewServer(log *logger.Logger, register func(s *grpc.Server), opts ...ServerOption) *Server {
+	s := &Server{
+		register: register,
+
+		keepaliveParams: DefaultKeepaliveParams,
+		keepalivePolicy: DefaultKeepalivePolicy,
+		maxRecvMsgSize:  DefaultMaxRecvMsgSize,
+		maxSendMsgSize:  DefaultMaxSendMsgSize,
+		stopTimeout:     DefaultStopTimeout,
+		reflection:      true,
+
+		ready: make(chan struct{}),
+
+		log: log,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Serve implements service.GRPCServer
+// It serves TLS with the certificate of pem and key, or plaintext when both
+// are empty and WithPlaintext allows it, until ctx is done or the listener
+// fails.
+func (s *Server) Serve(ctx context.Context, network, addr, pem, key string) error {
+	server, err := s.build(pem, key)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		s.reset()
+		return err
+	}
+
+	if s.grpcHealth != nil {
+		s.grpcHealth.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}
+	close(s.ready)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			s.stop(server)
+		case <-done:
+		}
+	}()
+
+	s.log.Infof("grpc: serving on %s %s", network, lis.Addr())
+
+	err = server.Serve(lis)
+	close(done)
+
+	// wait for the calls to finish when stopping
+	<-stopped
+
+	return err
+}
+
+// Ready returns a channel that is closed once the server accepts
+// connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// build returns the grpc.Server
+func (s *Server) build(pem, key string) (*grpc.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server != nil {
+		return nil, ErrServerStarted
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(s.keepaliveParams),
+		grpc.KeepaliveEnforcementPolicy(s.keepalivePolicy),
+		grpc.MaxRecvMsgSize(s.maxRecvMsgSize),
+		grpc.MaxSendMsgSize(s.maxSendMsgSize),
+	}
+
+	creds, err := s.credentials(pem, key)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	} else {
+		if err := s.checkPlaintext(); err != nil {
+			return nil, err
+		}
+		s.log.Warn("grpc: no pem and key, serving plaintext")
+	}
+
+	unary, stream, err := s.interceptors()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.UnaryInterceptor(unary), grpc.StreamInterceptor(stream))
+	opts = append(opts, s.grpcOptions...)
+
+	server := grpc.NewServer(opts...)
+
+	if s.health != nil {
+		healthpb.RegisterHealthServer(server, s.health.GRPCHealthServer())
+	} else {
+		s.grpcHealth = grpchealth.NewServer()
+		s.grpcHealth.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+		healthpb.RegisterHealthServer(server, s.grpcHealth)
+	}
+	if s.reflection {
+		reflection.Register(server)
+	}
+	if s.register != nil {
+		s.register(server)
+	}
+
+	s.server = server
+
+	return server, nil
+}
+
+// reset forgets a server that failed to serve
+func (s *Server) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.server = nil
+}
+
+// credentials returns the TLS credentials of pem and key, nil when both are
+// empty
+func (s *Server) credentials(pem, key string) (credentials.TransportCredentials, error) {
+	if pem == "" && key == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(pem, key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	config.Certificates = append(config.Certificates, cert)
+
+	return credentials.NewTLS(config), nil
+}
+
+// checkPlaintext returns an error when plaintext serving is not allowed
+func (s *Server) checkPlaintext() error {
+	if s.plaintext == false {
+		return errors.New("grpchelper: no pem and key, use TLS or WithPlaintext")
+	}
+	if s.plaintextENV != config.ServiceENVDev && s.plaintextENV != config.ServiceENVTesting {
+		return fmt.Errorf("grpchelper: plaintext serving is not allowed in %q env", s.plaintextENV)
+	}
+
+	return nil
+}
+
+// interceptors returns the unary and stream chains
+func (s *Server) interceptors() (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor, error) {
+	ui := NewCommonUnaryServerInterceptor(s.log, s.interceptorOptions...)
+	si := NewCommonStreamServerInterceptor(s.log, s.interceptorOptions...)
+
+	unary := []grpc.UnaryServerInterceptor{ui.RecoverInterceptor, ui.TraceInterceptor}
+	stream := []grpc.StreamServerInterceptor{si.RecoverInterceptor, si.TraceInterceptor, si.LogInterceptor}
+
+	if t := ui.trace; t != nil {
+		m, err := NewServerMetrics(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		unary = append(unary, m.UnaryInterceptor)
+		stream = append(stream, m.StreamInterceptor)
+	}
+
+	unary = append(unary, s.unaryInterceptors...)
+	stream = append(stream, s.streamInterceptors...)
+
+	return UnaryServerChan(unary...), StreamServerChain(stream...), nil
+}
+
+// stop stops server gracefully, and cancels the calls that did not finish
+// within the stop timeout
+func (s *Server) stop(server *grpc.Server) {
+	if s.grpcHealth != nil {
+		s.grpcHealth.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+
+	s.log.Infof("grpc: stopping, waiting up to %v for calls to finish", s.stopTimeout)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	t := time.NewTimer(s.stopTimeout)
+	defer t.Stop()
+
+	select {
+	case <-stopped:
+		s.log.Info("grpc: stopped")
+	case <-t.C:
+		server.Stop()
+		s.log.Warnf("grpc: calls did not finish within %v, cancelled", s.stopTimeout)
+	}
+}
+
+// Stop cancels the calls in progress and stops the server at once
+// Cancelling the context of Serve stops it gracefully instead.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+
+	if server != nil {
+		server.Stop()
+	}
+}
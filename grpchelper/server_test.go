@@ -0,0 +1,88 @@
+package grpchelper
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/servicekit/servicekit-go/config"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/service"
+)
+
+var _ service.GRPCServer = (*Server)(nil)
+
+func TestServerServe(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	registered := false
+	s := NewServer(&logger.Logger{}, func(*grpc.Server) { registered = true },
+		WithStopTimeout(time.Second), WithPlaintext(config.ServiceENVTesting))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, "tcp", addr, "", "")
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dialCancel()
+	conn, err := grpc.DialContext(dialCtx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(dialCtx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("health = %v, want SERVING", resp.Status)
+	}
+	if registered == false {
+		t.Fatal("services were not registered")
+	}
+
+	if err := s.Serve(ctx, "tcp", addr, "", ""); err != ErrServerStarted {
+		t.Fatalf("second Serve = %v, want ErrServerStarted", err)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve = %v after the context is done", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the context is done")
+	}
+}
+
+func TestServerPlaintextENV(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []ServerOption
+	}{
+		{"no option", nil},
+		{"production", []ServerOption{WithPlaintext(config.ServiceENVProd)}},
+		{"staging", []ServerOption{WithPlaintext(config.ServiceENVStaging)}},
+		{"empty env", []ServerOption{WithPlaintext("")}},
+	}
+
+	for _, tt := range tests {
+		s := NewServer(&logger.Logger{}, nil, tt.opts...)
+		if err := s.Serve(context.Background(), "tcp", "127.0.0.1:0", "", ""); err == nil {
+			t.Errorf("%s: plaintext Serve should fail", tt.name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package grpchelper
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+// WrappedServerStream is a grpc.ServerStream that carries an enriched context
+type WrappedServerStream struct {
+	grpc.ServerStream
+
+	// WrappedContext is returned by Context
+	WrappedContext context.Context
+
+	recv int64
+	sent int64
+
+	hasRequestID bool
+}
+
+// WrapServerStream returns a WrappedServerStream of stream
+// A stream that is wrapped already is returned as is, so that interceptors
+// share one wrapper.
+func WrapServerStream(stream grpc.ServerStream) *WrappedServerStream {
+	if w, ok := stream.(*WrappedServerStream); ok {
+		return w
+	}
+
+	return &WrappedServerStream{
+		ServerStream:   stream,
+		WrappedContext: stream.Context(),
+	}
+}
+
+// Context returns the enriched context
+func (w *WrappedServerStream) Context() context.Context {
+	return w.WrappedContext
+}
+
+// RecvMsg counts the received messages
+func (w *WrappedServerStream) RecvMsg(m interface{}) error {
+	err := w.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddInt64(&w.recv, 1)
+	}
+
+	return err
+}
+
+// SendMsg counts the sent messages
+func (w *WrappedServerStream) SendMsg(m interface{}) error {
+	err := w.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddInt64(&w.sent, 1)
+	}
+
+	return err
+}
+
+// Counts returns the count of received and sent messages
+func (w *WrappedServerStream) Counts() (recv, sent int64) {
+	return atomic.LoadInt64(&w.recv), atomic.LoadInt64(&w.sent)
+}
+
+// StreamServerChain returns a StreamServerInterceptor that chains
+// interceptors, the first one is the outermost
+// Like UnaryServerChan, the request ID is put into the context of the stream
+func StreamServerChain(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		buildChain := func(current grpc.StreamServerInterceptor, next grpc.StreamHandler) grpc.StreamHandler {
+			return func(currentSrv interface{}, currentStream grpc.ServerStream) error {
+				return current(currentSrv, currentStream, info, next)
+			}
+		}
+		chain := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			chain = buildChain(interceptors[i], chain)
+		}
+		return chain(srv, withStreamRequestID(ss))
+	}
+}
+
+// withStreamRequestID returns a wrapped stream whose context carries the
+// request ID
+func withStreamRequestID(ss grpc.ServerStream) *WrappedServerStream {
+	w := WrapServerStream(ss)
+	if w.hasRequestID {
+		return w
+	}
+
+	requestID := requestid.HandleRequestIDChain(w.WrappedContext)
+	w.WrappedContext = requestid.ContextWithRequestID(w.WrappedContext, requestID)
+	w.hasRequestID = true
+
+	return w
+}
+
+// CommonStreamServerInterceptor describe a stream server interceptor
+type CommonStreamServerInterceptor struct {
+	serverInterceptorOptions
+
+	log *logger.Logger
+}
+
+// NewCommonStreamServerInterceptor returns a CommonStreamServerInterceptor
+func NewCommonStreamServerInterceptor(log *logger.Logger, opts ...ServerInterceptorOption) *CommonStreamServerInterceptor {
+	return &CommonStreamServerInterceptor{
+		serverInterceptorOptions: newServerInterceptorOptions(opts, log),
+
+		log: log,
+	}
+}
+
+// RecoverInterceptor can recover a panic
+// The stream fails with codes.Internal and the request ID then, see
+// WithRecoveryHandler to return another error.
+func (i *CommonStreamServerInterceptor) RecoverInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = i.recovered(ss.Context(), i.log, info.FullMethod, r)
+		}
+	}()
+
+	return handler(srv, ss)
+}
+
+// RequestIDInterceptor puts the request ID into the context of the stream
+// It is not needed with StreamServerChain, which does so already.
+func (i *CommonStreamServerInterceptor) RequestIDInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, withStreamRequestID(ss))
+}
+
+// LogInterceptor logs the streams that fail, with their message counts
+func (i *CommonStreamServerInterceptor) LogInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	w := WrapServerStream(ss)
+
+	err := handler(srv, w)
+	if err != nil {
+		recv, sent := w.Counts()
+		i.log.Errorf("GRPC Stream: %v failed. RequestID: %v, recv: %d, sent: %d, err: %v",
+			info.FullMethod, requestid.GetRequestIDFromContext(w.Context()), recv, sent, err)
+	}
+
+	return err
+}
+
+// TraceInterceptor writes an access log of every stream
+// The fields are those of CommonUnaryServerInterceptor.TraceInterceptor,
+// with recv_msgs and sent_msgs instead of the sizes.
+func (i *CommonStreamServerInterceptor) TraceInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	startTime := time.Now()
+
+	w := WrapServerStream(ss)
+	err := handler(srv, w)
+
+	recv, sent := w.Counts()
+	i.accessLog(w.Context(), i.log, info.FullMethod, startTime, err, map[string]interface{}{
+		"recv_msgs": recv,
+		"sent_msgs": sent,
+	})
+
+	return err
+}
@@ -0,0 +1,90 @@
+package grpchelper
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+func TestStreamServerChainRequestID(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/account.Account/List"}
+	incoming := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestid.RequestIDKey, "rid-1"))
+
+	tests := []struct {
+		ctx context.Context
+		rid string
+	}{
+		{incoming, "rid-1,"},
+		{context.Background(), ""},
+	}
+
+	for _, tt := range tests {
+		var seen []string
+		interceptor := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			seen = append(seen, requestid.GetRequestIDFromContext(ss.Context()))
+			return handler(srv, ss)
+		}
+		handler := func(srv interface{}, ss grpc.ServerStream) error {
+			if _, ok := ss.(*WrappedServerStream); ok == false {
+				t.Errorf("the handler got a %T, want a WrappedServerStream", ss)
+			}
+			seen = append(seen, requestid.GetRequestIDFromContext(ss.Context()))
+			return nil
+		}
+
+		chain := StreamServerChain(interceptor, interceptor)
+		if err := chain(nil, &testServerStream{ctx: tt.ctx}, info, handler); err != nil {
+			t.Fatal(err)
+		}
+
+		// the incoming request ID is chained with the one of the call
+		if len(seen) != 3 || seen[0] == "" || strings.HasPrefix(seen[0], tt.rid) == false {
+			t.Fatalf("request IDs = %v, want a chain of %q", seen, tt.rid)
+		}
+		for _, rid := range seen[1:] {
+			if rid != seen[0] {
+				t.Errorf("request IDs = %v, want one request ID", seen)
+			}
+		}
+	}
+}
+
+func TestStreamServerChainOutgoingMetadata(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/account.Account/List"}
+	pass := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, ss)
+	}
+
+	chain := StreamServerChain(pass)
+	chain(nil, &testServerStream{ctx: incomingCredentials()}, info, func(srv interface{}, ss grpc.ServerStream) error {
+		checkOutgoing(t, ss.Context())
+		return nil
+	})
+}
+
+func TestStreamRecoverInterceptor(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/account.Account/List"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestid.RequestIDKey, "rid-1"))
+	i := NewCommonStreamServerInterceptor(&logger.Logger{})
+
+	chain := StreamServerChain(i.RecoverInterceptor, i.LogInterceptor)
+	err := chain(nil, &testServerStream{ctx: ctx}, info, func(srv interface{}, ss grpc.ServerStream) error {
+		panic("secret")
+	})
+
+	st := status.Convert(err)
+	if st.Code() != codes.Internal {
+		t.Errorf("code = %v, want Internal", st.Code())
+	}
+	if strings.Contains(st.Message(), "rid-1") == false || strings.Contains(st.Message(), "secret") {
+		t.Errorf("message = %q, want the request ID only", st.Message())
+	}
+}
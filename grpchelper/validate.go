@@ -0,0 +1,141 @@
+package grpchelper
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validator is a message with protoc-gen-validate Validate
+type validator interface {
+	Validate() error
+}
+
+// allValidator is a message with protoc-gen-validate ValidateAll, which
+// reports every violation instead of the first
+type allValidator interface {
+	ValidateAll() error
+}
+
+// fieldError is the error protoc-gen-validate returns for a field
+type fieldError interface {
+	Field() string
+	Reason() string
+}
+
+// causeError is a fieldError of an embedded message
+type causeError interface {
+	Cause() error
+}
+
+// multiError is the error of ValidateAll
+type multiError interface {
+	AllErrors() []error
+}
+
+// ValidateUnaryInterceptor is a grpc.UnaryServerInterceptor that validates
+// requests by their ValidateAll or Validate method
+// Invalid requests fail with codes.InvalidArgument and a BadRequest detail
+// that lists the violated fields, see InvalidArgumentError.
+func ValidateUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := validate(req); err != nil {
+		return nil, InvalidArgumentError(err)
+	}
+
+	return handler(ctx, req)
+}
+
+// ValidateStreamInterceptor is a grpc.StreamServerInterceptor that validates
+// every message received on a stream
+// RecvMsg returns the codes.InvalidArgument error of an invalid message.
+func ValidateStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &validatingServerStream{ServerStream: ss})
+}
+
+// validatingServerStream validates the received messages
+type validatingServerStream struct {
+	grpc.ServerStream
+}
+
+func (s *validatingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if err := validate(m); err != nil {
+		return InvalidArgumentError(err)
+	}
+
+	return nil
+}
+
+// validate returns the violations of m, nil when m cannot validate itself
+func validate(m interface{}) error {
+	switch v := m.(type) {
+	case allValidator:
+		return v.ValidateAll()
+	case validator:
+		return v.Validate()
+	}
+
+	return nil
+}
+
+// InvalidArgumentError returns a codes.InvalidArgument error whose
+// BadRequest detail lists the field violations of err
+// err is a protoc-gen-validate error; other errors are a violation without
+// field.
+func InvalidArgumentError(err error) error {
+	violations := fieldViolations(err)
+
+	msg := "invalid request"
+	if len(violations) > 0 {
+		msg += ": " + violations[0].Description
+		if violations[0].Field != "" {
+			msg = "invalid " + violations[0].Field + ": " + violations[0].Description
+		}
+	}
+
+	st := status.New(codes.InvalidArgument, msg)
+	if ds, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+		st = ds
+	}
+
+	return st.Err()
+}
+
+// fieldViolations returns the violations of a validation error
+func fieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	if me, ok := err.(multiError); ok {
+		var violations []*errdetails.BadRequest_FieldViolation
+		for _, e := range me.AllErrors() {
+			violations = append(violations, fieldViolations(e)...)
+		}
+		return violations
+	}
+
+	fe, ok := err.(fieldError)
+	if ok == false {
+		return []*errdetails.BadRequest_FieldViolation{{Description: err.Error()}}
+	}
+
+	// the violations of an embedded message are prefixed by its field
+	if ce, ok := err.(causeError); ok {
+		switch ce.Cause().(type) {
+		case fieldError, multiError:
+			violations := fieldViolations(ce.Cause())
+			for _, v := range violations {
+				if v.Field == "" {
+					v.Field = fe.Field()
+					continue
+				}
+				v.Field = fe.Field() + "." + v.Field
+			}
+			return violations
+		}
+	}
+
+	return []*errdetails.BadRequest_FieldViolation{{Field: fe.Field(), Description: fe.Reason()}}
+}
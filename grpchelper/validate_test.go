@@ -0,0 +1,69 @@
+package grpchelper
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testFieldError mimics a protoc-gen-validate field error
+type testFieldError struct {
+	field  string
+	reason string
+	cause  error
+}
+
+func (e testFieldError) Field() string  { return e.field }
+func (e testFieldError) Reason() string { return e.reason }
+func (e testFieldError) Cause() error   { return e.cause }
+func (e testFieldError) Error() string  { return e.field + ": " + e.reason }
+
+// testMultiError mimics a protoc-gen-validate multi error
+type testMultiError []error
+
+func (m testMultiError) AllErrors() []error { return m }
+func (m testMultiError) Error() string      { return "multiple errors" }
+
+type testValidRequest struct{ err error }
+
+func (r *testValidRequest) ValidateAll() error { return r.err }
+
+func TestValidateUnaryInterceptor(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	info := &grpc.UnaryServerInfo{FullMethod: "/account.Account/Create"}
+
+	if _, err := ValidateUnaryInterceptor(context.Background(), &testValidRequest{}, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &testValidRequest{err: testMultiError{
+		testFieldError{field: "Email", reason: "value must be a valid email address"},
+		testFieldError{field: "Address", reason: "embedded message failed validation", cause: testFieldError{field: "City", reason: "value length must be at least 1 runes"}},
+		errors.New("unknown"),
+	}}
+
+	_, err := ValidateUnaryInterceptor(context.Background(), req, info, handler)
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("code = %v, want InvalidArgument", st.Code())
+	}
+	if len(st.Details()) != 1 {
+		t.Fatalf("%d details, want 1", len(st.Details()))
+	}
+
+	br := st.Details()[0].(*errdetails.BadRequest)
+	want := []string{"Email", "Address.City", ""}
+	if len(br.FieldViolations) != len(want) {
+		t.Fatalf("%d violations, want %d", len(br.FieldViolations), len(want))
+	}
+	for i, v := range br.FieldViolations {
+		if v.Field != want[i] {
+			t.Errorf("violation %d field = %q, want %q", i, v.Field, want[i])
+		}
+	}
+}
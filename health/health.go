@@ -3,6 +3,10 @@ package health
 import (
 	"fmt"
 	"net/http"
+	"sync"
+
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/servicekit/servicekit-go/logger"
 )
@@ -31,6 +35,9 @@ type Health struct {
 	state  ServiceState
 	reason string
 	c      chan ServiceState
+	mu     sync.RWMutex
+
+	grpcHealth *grpchealth.Server
 
 	log *logger.Logger
 }
@@ -45,9 +52,13 @@ func NewHealth(host string, port int, path string, log *logger.Logger) *Health {
 		state: ServiceStateUnavailable,
 		c:     make(chan ServiceState),
 
+		grpcHealth: grpchealth.NewServer(),
+
 		log: log,
 	}
 
+	h.grpcHealth.SetServingStatus("", servingStatus(h.state))
+
 	go h.start()
 	go h.serve()
 
@@ -56,15 +67,30 @@ func NewHealth(host string, port int, path string, log *logger.Logger) *Health {
 	return h
 }
 
+// servingStatus returns the grpc serving status of a state
+// A Busy service is NOT_SERVING, so that balancers route away from it
+func servingStatus(state ServiceState) healthpb.HealthCheckResponse_ServingStatus {
+	switch state {
+	case ServiceStateOK, ServiceStateIdling:
+		return healthpb.HealthCheckResponse_SERVING
+	}
+
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
 // start update the state of service periodically
 func (h *Health) start() {
 	for {
 		s := <-h.c
+
+		h.mu.Lock()
 		oldState := h.state
 		h.state = s
+		h.mu.Unlock()
 
-		if oldState != h.state {
-			h.log.Infof("health: state changed. %v -> %v", oldState, h.state)
+		if oldState != s {
+			h.grpcHealth.SetServingStatus("", servingStatus(s))
+			h.log.Infof("health: state changed. %v -> %v", oldState, s)
 		}
 	}
 
@@ -75,10 +101,30 @@ func (h *Health) GetChan() chan<- ServiceState {
 	return h.c
 }
 
+// GetState returns the state of service
+func (h *Health) GetState() ServiceState {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.state
+}
+
+// GRPCHealthServer returns a grpc.health.v1 server that follows the state
+// Register it to a grpc server, so that clients stop sending requests as
+// soon as the service is not OK:
+//     healthpb.RegisterHealthServer(s, h.GRPCHealthServer())
+func (h *Health) GRPCHealthServer() *grpchealth.Server {
+	return h.grpcHealth
+}
+
 // handler is a http hander
+// A Busy service answers 503, so that http checks route away from it
 func (h *Health) handler(w http.ResponseWriter, req *http.Request) {
-	if h.state == ServiceStateUnavailable {
+	switch h.GetState() {
+	case ServiceStateUnavailable:
 		w.WriteHeader(500)
+	case ServiceStateBusy:
+		w.WriteHeader(503)
 	}
 }
 
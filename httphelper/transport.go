@@ -0,0 +1,364 @@
+package httphelper
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/balancer"
+	consul "github.com/servicekit/servicekit-go/balancer/consul"
+	"github.com/servicekit/servicekit-go/coordinator"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+)
+
+const (
+	// ServiceDomain is the host suffix of the URLs resolved by Transport
+	ServiceDomain = ".service"
+	// DefaultMaxRetries is the count of retries of idempotent requests
+	DefaultMaxRetries = 2
+)
+
+// Transport is a http.RoundTripper that resolves service URLs through a
+// coordinator.Coordinator and balances the requests across the instances
+// A request to http://account.service/path goes to an instance of the
+// account service, and http://v2.account.service/path to an instance tagged
+// v2, like the Consul DNS interface. Other URLs are sent unchanged.
+//
+// The instances are balanced like BalanceDial does for gRPC: they are
+// resolved by the consul Resolver, routed by a balancer.Router and skipped
+// while ejected by a balancer.OutlierDetector. Idempotent requests that
+// fail with a network error or a 502, 503 or 504 are retried on the next
+// instance. The request ID header is set from the context, see
+// requestid.SetRequestIDToHTTPRequest.
+type Transport struct {
+	c   coordinator.Coordinator
+	log *logger.Logger
+
+	base          http.RoundTripper
+	router        *balancer.Router
+	outlierConfig balancer.OutlierConfig
+	resolverOpts  []consul.ResolverOption
+	maxRetries    int
+
+	mu        sync.Mutex
+	balancers map[string]*serviceBalancer
+	closed    bool
+}
+
+// TransportOption configures a Transport
+type TransportOption func(t *Transport)
+
+// WithBase sends the requests by rt, http.DefaultTransport by default
+func WithBase(rt http.RoundTripper) TransportOption {
+	return func(t *Transport) {
+		t.base = rt
+	}
+}
+
+// WithRouter routes the requests by router, the rule headers are matched
+// against the request headers
+func WithRouter(router *balancer.Router) TransportOption {
+	return func(t *Transport) {
+		t.router = router
+	}
+}
+
+// WithOutlierConfig configures the OutlierDetector of every service
+func WithOutlierConfig(config balancer.OutlierConfig) TransportOption {
+	return func(t *Transport) {
+		t.outlierConfig = config
+	}
+}
+
+// WithResolverOptions configures the resolver of every service, e.g.
+// consul.WithFilter
+func WithResolverOptions(opts ...consul.ResolverOption) TransportOption {
+	return func(t *Transport) {
+		t.resolverOpts = opts
+	}
+}
+
+// WithMaxRetries sets the count of retries of idempotent requests, zero
+// disables retries
+func WithMaxRetries(n int) TransportOption {
+	return func(t *Transport) {
+		t.maxRetries = n
+	}
+}
+
+// NewTransport returns a Transport that resolves services through c
+func NewTransport(c coordinator.Coordinator, log *logger.Logger, opts ...TransportOption) *Transport {
+	t := &Transport{
+		c:   c,
+		log: log,
+
+		base:          http.DefaultTransport,
+		outlierConfig: balancer.DefaultOutlierConfig(),
+		maxRetries:    DefaultMaxRetries,
+
+		balancers: make(map[string]*serviceBalancer),
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+// NewClient returns a http.Client that uses a Transport
+func NewClient(c coordinator.Coordinator, log *logger.Logger, opts ...TransportOption) *http.Client {
+	return &http.Client{Transport: NewTransport(c, log, opts...)}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	service, tag, ok := parseHost(req.URL.Hostname())
+	if ok == false {
+		return t.base.RoundTrip(req)
+	}
+
+	b, err := t.getBalancer(service, tag)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	ctx := context.Context(req.Context())
+	header := cloneHeader(req.Header)
+	requestid.SetRequestIDToHTTPRequest(ctx, &http.Request{Header: header})
+	// The router matches rule headers against outgoing metadata
+	ctx = metadata.NewOutgoingContext(ctx, headerMetadata(header))
+
+	attempts := 1
+	if isIdempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil) {
+		attempts += t.maxRetries
+	}
+
+	var resp *http.Response
+	for i := 0; i < attempts; i++ {
+		body := req.Body
+		if i > 0 {
+			if resp != nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if req.GetBody != nil {
+				if body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		addr, _, err := b.rr.Get(ctx, grpc.BalancerGetOptions{BlockingWait: true})
+		if err != nil {
+			// body is req.Body or, on a retry, the copy of GetBody
+			if body != nil {
+				body.Close()
+			}
+			return nil, fmt.Errorf("httphelper: no instance of %s: %v", service, err)
+		}
+
+		outReq := req.WithContext(req.Context())
+		outReq.URL = cloneURLWithHost(req, addr.Addr)
+		outReq.Host = req.Host
+		if outReq.Host == "" {
+			outReq.Host = req.URL.Host
+		}
+		outReq.Header = header
+		outReq.Body = body
+
+		start := time.Now()
+		resp, err = t.base.RoundTrip(outReq)
+		b.outliers.Report(addr.Addr, backendError(resp, err), time.Since(start))
+
+		if i == attempts-1 || req.Context().Err() != nil || retryable(resp, err) == false {
+			return resp, err
+		}
+
+		t.log.Debugf("httphelper: retrying %s %s on another instance: %v", req.Method, req.URL, backendError(resp, err))
+	}
+
+	return resp, nil
+}
+
+// Close stops resolving the services
+func (t *Transport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for key, b := range t.balancers {
+		b.rr.Close()
+		delete(t.balancers, key)
+	}
+}
+
+// getBalancer returns the balancer of service and tag, it is created on
+// first use
+func (t *Transport) getBalancer(service, tag string) (*serviceBalancer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, fmt.Errorf("httphelper: transport is closed")
+	}
+
+	key := tag + "." + service
+	if b, ok := t.balancers[key]; ok {
+		return b, nil
+	}
+
+	resolver, err := consul.GetResolver(t.c, service, tag, t.log, t.resolverOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	outliers := balancer.NewOutlierDetector(t.outlierConfig)
+	rr := balancer.NewRoundRobin(resolver, t.router, balancer.WithOutlierDetector(outliers))
+	if err := rr.Start(service, grpc.BalancerConfig{}); err != nil {
+		return nil, err
+	}
+
+	b := &serviceBalancer{
+		rr:       rr,
+		outliers: outliers,
+	}
+	go b.watch()
+
+	t.balancers[key] = b
+
+	return b, nil
+}
+
+// serviceBalancer balances the requests to a service
+type serviceBalancer struct {
+	rr       *balancer.RoundRobin
+	outliers *balancer.OutlierDetector
+}
+
+// watch marks the resolved addresses up until the balancer is closed
+// There is no connection to wait for, every address is usable at once.
+func (b *serviceBalancer) watch() {
+	downs := make(map[string]func(error))
+
+	for addrs := range b.rr.Notify() {
+		present := make(map[string]struct{}, len(addrs))
+		for _, addr := range addrs {
+			present[addr.Addr] = struct{}{}
+			// Up returns nil when addr is up already
+			if down := b.rr.Up(addr); down != nil {
+				downs[addr.Addr] = down
+			}
+		}
+
+		for addr, down := range downs {
+			if _, ok := present[addr]; ok == false {
+				down(nil)
+				delete(downs, addr)
+			}
+		}
+	}
+}
+
+// parseHost returns the service and tag of a service host, e.g.
+// account.service or v2.account.service
+func parseHost(host string) (service, tag string, ok bool) {
+	host = strings.ToLower(host)
+	if strings.HasSuffix(host, ServiceDomain) == false {
+		return "", "", false
+	}
+
+	service = strings.TrimSuffix(host, ServiceDomain)
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		tag, service = service[:i], service[i+1:]
+	}
+
+	return service, tag, service != ""
+}
+
+// isIdempotent returns true when req can be sent again
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// retryable returns true when the request should be sent to another
+// instance
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// backendError returns the outcome of a request as seen by the
+// OutlierDetector, gRPC Unavailable for network errors and gateway errors
+func backendError(resp *http.Response, err error) error {
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	if retryable(resp, nil) {
+		return status.Errorf(codes.Unavailable, "http status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// headerMetadata returns the metadata of header, keys are lower case
+func headerMetadata(header http.Header) metadata.MD {
+	md := make(metadata.MD, len(header))
+	for k, v := range header {
+		md[strings.ToLower(k)] = v
+	}
+
+	return md
+}
+
+// cloneHeader returns a copy of header
+func cloneHeader(header http.Header) http.Header {
+	h := make(http.Header, len(header))
+	for k, v := range header {
+		h[k] = append([]string(nil), v...)
+	}
+
+	return h
+}
+
+// cloneURLWithHost returns a copy of the URL of req that points to addr
+func cloneURLWithHost(req *http.Request, addr string) *url.URL {
+	u := *req.URL
+	u.Host = addr
+
+	return &u
+}
+
+// closeBody closes the body of a request that is not sent
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package httphelper
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	coordinator "github.com/servicekit/servicekit-go/coordinator/consul"
+	"github.com/servicekit/servicekit-go/logger"
+	"github.com/servicekit/servicekit-go/requestid"
+	"github.com/servicekit/servicekit-go/spec"
+)
+
+func testService(t *testing.T, id string, s *httptest.Server) *spec.Service {
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	return &spec.Service{ID: id, Service: "account", Address: host, Port: p}
+}
+
+func TestTransportRetry(t *testing.T) {
+	var requestIDs []string
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs = append(requestIDs, r.Header.Get(requestid.RequestIDKey))
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs = append(requestIDs, r.Header.Get(requestid.RequestIDKey))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	tc := &coordinator.TestConsul{
+		GetServicesServices: []*spec.Service{testService(t, "account-1", ok), testService(t, "account-2", unavailable)},
+		GetServicesMeta:     &api.QueryMeta{},
+	}
+
+	transport := NewTransport(tc, &logger.Logger{})
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 4; i++ {
+		requestIDs = nil
+		resp, err := client.Get("http://account.service/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want 200", resp.StatusCode)
+		}
+		for _, id := range requestIDs {
+			if id == "" || id != requestIDs[0] {
+				t.Errorf("request IDs = %v, want the same ID on every attempt", requestIDs)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://account.service/ping", nil)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			return
+		}
+	}
+	t.Error("POST should not be retried")
+}
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		host, service, tag string
+		ok                 bool
+	}{
+		{"account.service", "account", "", true},
+		{"v2.Account.service", "account", "v2", true},
+		{"example.com", "", "", false},
+		{".service", "", "", false},
+	}
+
+	for _, tt := range tests {
+		service, tag, ok := parseHost(tt.host)
+		if service != tt.service || tag != tt.tag || ok != tt.ok {
+			t.Errorf("parseHost(%q) = %q, %q, %v", tt.host, service, tag, ok)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package invoker
 
 import (
-	"fmt"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/servicekit/servicekit-go/apperror"
 )
 
 const (
@@ -22,10 +24,24 @@ type FailoverInvoker struct {
 	tries   int
 	timeout time.Duration
 	delay   Delay
+
+	retryDeadlineExceeded bool
+}
+
+// FailoverOption configures a FailoverInvoker
+type FailoverOption func(*FailoverInvoker)
+
+// WithRetryDeadlineExceeded retries the calls that failed with
+// DeadlineExceeded too
+// Use it for idempotent methods only: the call may have been applied.
+func WithRetryDeadlineExceeded() FailoverOption {
+	return func(f *FailoverInvoker) {
+		f.retryDeadlineExceeded = true
+	}
 }
 
 // NewFailoverInvoker returns an Invoker
-func NewFailoverInvoker(tries int, timeout time.Duration, delay Delay) Invoker {
+func NewFailoverInvoker(tries int, timeout time.Duration, delay Delay, opts ...FailoverOption) Invoker {
 	if tries > MaxTries {
 		tries = MaxTries
 	}
@@ -34,28 +50,58 @@ func NewFailoverInvoker(tries int, timeout time.Duration, delay Delay) Invoker {
 		timeout = MaxTimeout
 	}
 
-	return &FailoverInvoker{
+	f := &FailoverInvoker{
 		tries:   tries,
 		timeout: timeout,
 		delay:   delay,
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
 }
 
 // Invoke method invoke grpc.Invoke that can be retry when invoke failed
+// Only the errors apperror.Retryable accepts are retried, after the delay
+// or the RetryInfo delay of the error when longer. Other errors, e.g.
+// NotFound or InvalidArgument, are returned at once, and so is
+// DeadlineExceeded unless WithRetryDeadlineExceeded is set.
 func (f *FailoverInvoker) Invoke(ctx context.Context, conn *grpc.ClientConn, method string, request, response interface{}, opts ...grpc.CallOption) error {
 	var err error
 
 	for i := 0; i < f.tries; i++ {
 		err = grpc.Invoke(ctx, method, request, response, conn, opts...)
-		if err != nil {
-			delay := f.delay.GetDelay()
-			time.Sleep(delay)
-			fmt.Println(i, delay)
-			continue
+		if err == nil {
+			return nil
 		}
 
-		return nil
+		if f.retryable(err) == false || i == f.tries-1 {
+			return err
+		}
+
+		delay := f.delay.GetDelay()
+		if d := apperror.FromError(err).RetryDelay; d > delay {
+			delay = d
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
 	}
 
 	return err
 }
+
+// retryable returns true when the call that failed with err is retried
+func (f *FailoverInvoker) retryable(err error) bool {
+	if f.retryDeadlineExceeded && apperror.Code(err) == codes.DeadlineExceeded {
+		return true
+	}
+
+	return apperror.Retryable(err)
+}
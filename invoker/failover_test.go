@@ -0,0 +1,106 @@
+package invoker
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/servicekit/servicekit-go/apperror"
+)
+
+// testConn returns a connection whose calls fail with the errors of errs in
+// turn, the last one repeated, and the count of calls
+func testConn(t *testing.T, errs ...error) (*grpc.ClientConn, *int) {
+	calls := 0
+	interceptor := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := errs[len(errs)-1]
+		if calls < len(errs) {
+			err = errs[calls]
+		}
+		calls++
+		return err
+	}
+
+	conn, err := grpc.Dial("test", grpc.WithInsecure(), grpc.WithUnaryInterceptor(interceptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, &calls
+}
+
+func TestFailoverInvoker(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	deadline := status.Error(codes.DeadlineExceeded, "deadline exceeded")
+
+	tests := []struct {
+		name  string
+		errs  []error
+		opts  []FailoverOption
+		code  codes.Code
+		calls int
+	}{
+		{"retried until success", []error{unavailable, unavailable, nil}, nil, codes.OK, 3},
+		{"retried until tries", []error{unavailable}, nil, codes.Unavailable, 3},
+		{"not found", []error{status.Error(codes.NotFound, "not found"), nil}, nil, codes.NotFound, 1},
+		{"conflict", []error{apperror.Conflict("VERSION_MISMATCH", "conflict").GRPCStatus().Err(), nil}, nil, codes.Aborted, 1},
+		{"deadline", []error{deadline, nil}, nil, codes.DeadlineExceeded, 1},
+		{"deadline retried", []error{deadline, nil}, []FailoverOption{WithRetryDeadlineExceeded()}, codes.OK, 2},
+	}
+
+	for _, tt := range tests {
+		conn, calls := testConn(t, tt.errs...)
+		i := NewFailoverInvoker(3, time.Second, NewDelay(time.Millisecond), tt.opts...)
+
+		err := i.Invoke(context.Background(), conn, "/account.Account/Get", nil, nil)
+		conn.Close()
+
+		if status.Code(err) != tt.code || *calls != tt.calls {
+			t.Errorf("%s: Invoke = %v after %d calls, want %v after %d", tt.name, err, *calls, tt.code, tt.calls)
+		}
+	}
+}
+
+func TestFailoverInvokerRetryDelay(t *testing.T) {
+	retryDelay := 100 * time.Millisecond
+	conn, _ := testConn(t, apperror.Unavailable("DB_UNAVAILABLE", retryDelay, "unavailable").GRPCStatus().Err(), nil)
+	defer conn.Close()
+
+	i := NewFailoverInvoker(2, time.Second, NewDelay(time.Millisecond))
+
+	start := time.Now()
+	if err := i.Invoke(context.Background(), conn, "/account.Account/Get", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < retryDelay {
+		t.Errorf("retried after %v, before the RetryInfo delay %v", elapsed, retryDelay)
+	}
+}
+
+func TestFailoverInvokerCanceled(t *testing.T) {
+	conn, calls := testConn(t, status.Error(codes.Unavailable, "connection refused"))
+	defer conn.Close()
+
+	i := NewFailoverInvoker(MaxTries, time.Second, NewDelay(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- i.Invoke(ctx, conn, "/account.Account/Get", nil, nil)
+	}()
+
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable || *calls != 1 {
+			t.Errorf("Invoke = %v after %d calls, want the last error at once", err, *calls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Invoke kept retrying after ctx was done")
+	}
+}
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"log/syslog"
 	"runtime"
 
@@ -29,13 +30,7 @@ func NewLogger(serviceName, serviceVersion string, serviceENV config.ServiceENV,
 	logger := &Logger{Active: true}
 	logger.logger = log.New()
 
-	logger.logger.Formatter = &log.JSONFormatter{
-		FieldMap: log.FieldMap{
-			log.FieldKeyTime:  "@timestamp",
-			log.FieldKeyLevel: "@level",
-			log.FieldKeyMsg:   "@message",
-		},
-	}
+	logger.logger.Formatter = jsonFormatter()
 
 	hook, err := logrus_syslog.NewSyslogHook(network, addr, priority, fmt.Sprintf("%s_%s_%s", serviceName, serviceVersion, serviceENV))
 	if err != nil {
@@ -47,6 +42,29 @@ func NewLogger(serviceName, serviceVersion string, serviceENV config.ServiceENV,
 	return logger, nil
 }
 
+// NewWriterLogger returns a Logger that writes to out instead of syslog
+// The entries are the JSON lines of NewLogger, e.g. for stdout in a
+// container or for tests that check the logs.
+func NewWriterLogger(out io.Writer) *Logger {
+	logger := &Logger{Active: true}
+	logger.logger = log.New()
+	logger.logger.Out = out
+	logger.logger.Formatter = jsonFormatter()
+
+	return logger
+}
+
+// jsonFormatter returns the formatter of the JSON lines of a Logger
+func jsonFormatter() log.Formatter {
+	return &log.JSONFormatter{
+		FieldMap: log.FieldMap{
+			log.FieldKeyTime:  "@timestamp",
+			log.FieldKeyLevel: "@level",
+			log.FieldKeyMsg:   "@message",
+		},
+	}
+}
+
 // Debugf will invoke logrus.Debugf
 func (logger *Logger) Debugf(format string, args ...interface{}) {
 	if logger.Active == false {
@@ -258,11 +276,18 @@ func (logger *Logger) Panic(args ...interface{}) {
 }
 
 // WithFields returns an Entry with fields
+// The Entry of an inactive Logger writes nothing.
 func (logger *Logger) WithFields(fields map[string]interface{}) *log.Entry {
 	f := make(log.Fields)
 	for k, v := range fields {
 		f[k] = v
 	}
 
-	return logger.logger.WithFields(fields)
+	if logger.Active == false || logger.logger == nil {
+		l := log.New()
+		l.Out = &NullWriter{}
+		return l.WithFields(f)
+	}
+
+	return logger.logger.WithFields(f)
 }
@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriterLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := NewWriterLogger(&out)
+
+	l.Warnf("account %s not found", "alice")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("the entry %q is not JSON: %v", out.String(), err)
+	}
+	if entry["@level"] != "warning" {
+		t.Errorf("@level = %v, want warning", entry["@level"])
+	}
+	if msg, _ := entry["@message"].(string); strings.HasSuffix(msg, "account alice not found") == false {
+		t.Errorf("@message = %q, want the formatted message", msg)
+	}
+	if _, ok := entry["@timestamp"]; ok == false {
+		t.Error("the entry has no @timestamp")
+	}
+
+	out.Reset()
+	l.Active = false
+	l.Warnf("account %s not found", "bob")
+	if out.Len() != 0 {
+		t.Errorf("an inactive logger wrote %q", out.String())
+	}
+}
@@ -77,6 +77,25 @@ func UpdateContextWithRequestID(ctx context.Context, requestID string) context.C
 	return ctx
 }
 
+// ContextWithRequestID set a requestID to context and to its outgoing
+// metadata
+// Unlike UpdateContextWithRequestID, the incoming metadata is not copied to
+// the outgoing metadata, so that the credentials of a caller, e.g. its
+// authorization header, are not forwarded to the services called in turn.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md.Set(RequestIDKey, requestID)
+
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	ctx = context.WithValue(ctx, contextKey(RequestIDKey), requestID)
+	return ctx
+}
+
 // GetRequestID got requestid from context
 func GetRequestID(ctx context.Context) string {
 	md, ok := metadata.FromIncomingContext(ctx)
@@ -102,3 +121,33 @@ func GetRequestIDFromHTTPRequest(ctx context.Context, r *http.Request) (context.
 	ctx = context.WithValue(ctx, contextKey(RequestIDKey), requestID)
 	return ctx, requestID
 }
+
+// GetRequestIDFromContext got requestid from context
+// It returns the requestid set by UpdateContextWithRequestID,
+// ContextWithRequestID or GetRequestIDFromHTTPRequest, or else the one in
+// incoming metadata
+func GetRequestIDFromContext(ctx context.Context) string {
+	if requestID, ok := ctx.Value(contextKey(RequestIDKey)).(string); ok && requestID != "" {
+		return requestID
+	}
+
+	return GetRequestID(ctx)
+}
+
+// SetRequestIDToHTTPRequest set requestid to the header of http request
+// The requestid already in header is kept, otherwise it is got from context
+// or created, see GetRequestIDFromContext
+func SetRequestIDToHTTPRequest(ctx context.Context, r *http.Request) string {
+	requestID := r.Header.Get(RequestIDKey)
+	if requestID != "" {
+		return requestID
+	}
+
+	requestID = GetRequestIDFromContext(ctx)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	r.Header.Set(RequestIDKey, requestID)
+	return requestID
+}
@@ -1,21 +1,53 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/servicekit/servicekit-go/coordinator"
+	"github.com/servicekit/servicekit-go/health"
 	"github.com/servicekit/servicekit-go/logger"
 	"github.com/servicekit/servicekit-go/spec"
 )
 
+const (
+	// DefaultPropagationDelay is the time a stopping service keeps serving
+	// after it deregistered, so that clients see it is gone
+	DefaultPropagationDelay = 5 * time.Second
+	// DefaultShutdownTimeout is the time Stop waits for the service to drain
+	DefaultShutdownTimeout = 30 * time.Second
+	// DefaultReadyTimeout is the time Start waits for the server to be ready
+	DefaultReadyTimeout = 30 * time.Second
+
+	// readyInterval is the interval of the readiness probes
+	readyInterval = 50 * time.Millisecond
+)
+
+// ErrServerStopped is reported when the server stops without error while
+// the service is neither shut down nor cancelled
+var ErrServerStopped = errors.New("service: server stopped unexpectedly")
+
 // GRPCServer has a method Serve that serve a grpc server
+// Serve stops gracefully when ctx is done. A server that also has a Stop
+// method is stopped by it when the graceful stop takes too long.
 type GRPCServer interface {
 	Serve(ctx context.Context, network, addr, pem, key string) error
 }
 
+// ReadyServer is a GRPCServer that tells when it accepts connections
+// Servers that are not ReadyServers are probed by connecting to them.
+type ReadyServer interface {
+	Ready() <-chan struct{}
+}
+
 // GRPCService is a service implementation for grpc
 type GRPCService struct {
 	ID      string
@@ -32,14 +64,66 @@ type GRPCService struct {
 
 	c coordinator.Coordinator
 
+	health           *health.Health
+	propagationDelay time.Duration
+	readyTimeout     time.Duration
+	errorHandler     func(err error)
+
+	mu             sync.Mutex
+	cancelServe    context.CancelFunc
+	cancelRegister context.CancelFunc
+	served         chan struct{}
+	serveErr       error
+	stopping       bool
+	once           sync.Once
+	done           chan struct{}
+	shutdownErr    error
+
 	log *logger.Logger
 
 	errorChan chan error
 }
 
+// GRPCServiceOption configures a GRPCService
+type GRPCServiceOption func(g *GRPCService)
+
+// WithHealth registers the service only once h is OK, and sets h to
+// health.ServiceStateUnavailable first when the service stops
+// The registry check follows h: it is warning while h is Busy and critical
+// while h is Unavailable, so that clients route away.
+func WithHealth(h *health.Health) GRPCServiceOption {
+	return func(g *GRPCService) {
+		g.health = h
+	}
+}
+
+// WithPropagationDelay sets the time the service keeps serving after it
+// deregistered, DefaultPropagationDelay by default
+func WithPropagationDelay(d time.Duration) GRPCServiceOption {
+	return func(g *GRPCService) {
+		g.propagationDelay = d
+	}
+}
+
+// WithReadyTimeout sets the time Start waits for the server to be ready,
+// DefaultReadyTimeout by default
+func WithReadyTimeout(d time.Duration) GRPCServiceOption {
+	return func(g *GRPCService) {
+		g.readyTimeout = d
+	}
+}
+
+// WithErrorHandler calls f with the errors of the server once the service is
+// registered, see Errors
+func WithErrorHandler(f func(err error)) GRPCServiceOption {
+	return func(g *GRPCService) {
+		g.errorHandler = f
+	}
+}
+
 // NewGRPCService returns a GRPCService
-func NewGRPCService(id string, service string, tags []string, address string, port int, server GRPCServer, pem, key string, ttl time.Duration, c coordinator.Coordinator, log *logger.Logger) *GRPCService {
-	return &GRPCService{
+func NewGRPCService(id string, service string, tags []string, address string, port int, server GRPCServer, pem, key string, ttl time.Duration, c coordinator.Coordinator, log *logger.Logger, opts ...GRPCServiceOption) *GRPCService {
+	g := &GRPCService{
 		ID:      id,
 		Service: service,
 		Tags:    tags,
@@ -52,10 +136,22 @@ func NewGRPCService(id string, service string, tags []string, address string, po
 
 		TTL: ttl,
 		c:   c,
+
+		propagationDelay: DefaultPropagationDelay,
+		readyTimeout:     DefaultReadyTimeout,
+
+		done: make(chan struct{}),
+
 		log: log,
 
-		errorChan: make(chan error),
+		errorChan: make(chan error, 1),
+	}
+
+	for _, opt := range opts {
+		opt(g)
 	}
+
+	return g
 }
 
 // getService returns a spec.Service
@@ -70,28 +166,292 @@ func (g *GRPCService) getService() *spec.Service {
 }
 
 // Start will create a goroutine to invoke grpcservice.server.Serve
-// When no received an error from errorChan, register service to coordinator
+// The service is registered to the coordinator after delayRegisterTime,
+// once the server accepts connections and, with WithHealth, the health is
+// OK. Start fails when the server fails, or is not ready within the ready
+// timeout after delayRegisterTime, see WithReadyTimeout. Once registered, a
+// failure of the server deregisters the service and is reported by Errors.
+// The service runs until ctx is done or Stop is called.
 func (g *GRPCService) Start(ctx context.Context, delayRegisterTime time.Duration) error {
+	serveCtx, cancelServe := context.WithCancel(ctx)
+	registerCtx, cancelRegister := context.WithCancel(ctx)
+	served := make(chan struct{})
+
+	g.mu.Lock()
+	g.cancelServe = cancelServe
+	g.cancelRegister = cancelRegister
+	g.served = served
+	g.mu.Unlock()
+
 	go func() {
 		err := g.server.Serve(
-			ctx,
+			serveCtx,
 			"tcp",
 			fmt.Sprintf("%s:%d", g.Address, g.Port),
 			g.pem,
 			g.key,
 		)
-		g.errorChan <- err
+
+		g.mu.Lock()
+		g.serveErr = err
+		g.mu.Unlock()
+		close(served)
 	}()
 
-	time.Sleep(delayRegisterTime)
+	if err := g.waitReady(ctx, served, delayRegisterTime); err != nil {
+		cancelServe()
+		cancelRegister()
+		return err
+	}
+
+	if g.health != nil {
+		registerCtx = coordinator.WithCheckFunc(registerCtx, g.checkStatus)
+	}
+	if err := g.c.Register(registerCtx, g.getService(), g.TTL); err != nil {
+		cancelServe()
+		cancelRegister()
+		return err
+	}
+
+	g.log.Infof("service: %s registered", g.ID)
+
+	go g.watch(ctx, served)
+
+	return nil
+}
+
+// Errors returns the channel of the errors that stopped the server once
+// the service was registered
+// The channel is buffered: the first error is kept when nobody reads it,
+// the later ones are dropped.
+func (g *GRPCService) Errors() <-chan error {
+	return g.errorChan
+}
+
+// waitReady waits for delay, and then until the server accepts connections
+// and the health is OK
+func (g *GRPCService) waitReady(ctx context.Context, served chan struct{}, delay time.Duration) error {
+	delayed := time.Now().Add(delay)
+	t := time.NewTimer(delay + g.readyTimeout)
+	defer t.Stop()
+
+	var ready <-chan struct{}
+	if rs, ok := g.server.(ReadyServer); ok {
+		ready = rs.Ready()
+	}
+
+	ticker := time.NewTicker(readyInterval)
+	defer ticker.Stop()
+
+	readyChan := ready
+	for {
+		if time.Now().Before(delayed) == false && g.ready(ready) {
+			return nil
+		}
+
+		select {
+		case <-served:
+			g.mu.Lock()
+			err := g.serveErr
+			g.mu.Unlock()
+			if err == nil {
+				err = ErrServerStopped
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			return fmt.Errorf("service: %s not ready within %v", g.ID, g.readyTimeout)
+		case <-readyChan:
+			// the health is not OK yet, it is polled from now on
+			readyChan = nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ready returns true when the server accepts connections and the health is
+// OK
+// ready is the Ready channel of the server, nil when the server is probed.
+func (g *GRPCService) ready(ready <-chan struct{}) bool {
+	if ready != nil {
+		select {
+		case <-ready:
+		default:
+			return false
+		}
+	} else if g.Port != 0 {
+		host := g.Address
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, fmt.Sprint(g.Port)), readyInterval)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+
+	return g.health == nil || g.health.GetState() == health.ServiceStateOK
+}
+
+// checkStatus returns the registry check status of the health state
+func (g *GRPCService) checkStatus() string {
+	switch g.health.GetState() {
+	case health.ServiceStateBusy:
+		return coordinator.CheckWarning
+	case health.ServiceStateUnavailable:
+		return coordinator.CheckCritical
+	}
+
+	return coordinator.CheckPassing
+}
 
-	var err error
+// watch deregisters the service when the server stops on its own, and
+// reports why
+func (g *GRPCService) watch(ctx context.Context, served chan struct{}) {
+	<-served
+
+	g.mu.Lock()
+	err, stopping, cancelRegister := g.serveErr, g.stopping, g.cancelRegister
+	g.mu.Unlock()
+
+	if stopping {
+		return
+	}
+
+	cancelRegister()
+	if derr := g.c.Deregister(context.Background(), g.ID); derr != nil {
+		g.log.Errorf("service: %s deregister failed: %v", g.ID, derr)
+	}
+
+	if ctx.Err() != nil {
+		g.log.Infof("service: %s stopped: %v", g.ID, ctx.Err())
+		return
+	}
+
+	if err == nil {
+		err = ErrServerStopped
+	}
+	g.log.Errorf("service: %s server failed, deregistered: %v", g.ID, err)
 
 	select {
-	case err = <-g.errorChan:
+	case g.errorChan <- err:
 	default:
-		err = g.c.Register(ctx, g.getService(), g.TTL)
+	}
+	if g.errorHandler != nil {
+		g.errorHandler(err)
+	}
+}
+
+// Stop drains and stops the service within DefaultShutdownTimeout, see
+// Shutdown
+func (g *GRPCService) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+
+	return g.Shutdown(ctx)
+}
+
+// Shutdown drains and stops the service
+// The health becomes Unavailable, the service is deregistered and keeps
+// serving for the propagation delay, so that clients route away, then the
+// server stops gracefully. When ctx is done first, the server is stopped
+// at once if it has a Stop method, and ctx.Err() is returned. Only the
+// first call shuts down; the others wait for it.
+func (g *GRPCService) Shutdown(ctx context.Context) error {
+	g.once.Do(func() {
+		g.shutdownErr = g.shutdown(ctx)
+		close(g.done)
+	})
+
+	<-g.done
+
+	return g.shutdownErr
+}
+
+// Done returns a channel that is closed when the service has shut down
+func (g *GRPCService) Done() <-chan struct{} {
+	return g.done
+}
+
+// shutdown follows the drain sequence of Shutdown
+func (g *GRPCService) shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	cancelServe, cancelRegister, served := g.cancelServe, g.cancelRegister, g.served
+	g.stopping = true
+	g.mu.Unlock()
+
+	g.log.Infof("service: %s shutting down", g.ID)
+
+	if g.health != nil {
+		g.health.GetChan() <- health.ServiceStateUnavailable
+	}
+
+	if cancelRegister != nil {
+		cancelRegister()
+	}
+	if err := g.c.Deregister(ctx, g.ID); err != nil {
+		g.log.Errorf("service: %s deregister failed: %v", g.ID, err)
+	}
+
+	if served == nil {
+		return nil
+	}
+
+	t := time.NewTimer(g.propagationDelay)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+	case <-served:
+		t.Stop()
+	}
+
+	cancelServe()
+
+	select {
+	case <-served:
+		g.log.Infof("service: %s stopped", g.ID)
+		return nil
+	case <-ctx.Done():
+	}
+
+	if s, ok := g.server.(interface{ Stop() }); ok {
+		g.log.Warnf("service: %s did not drain in time, stopping at once", g.ID)
+		s.Stop()
+		<-served
+	}
+
+	return ctx.Err()
+}
+
+// ShutdownOnSignal shuts the service down within timeout when the process
+// receives one of signals, SIGTERM and SIGINT by default
+// It returns at once; wait for Done before exiting.
+func (g *GRPCService) ShutdownOnSignal(timeout time.Duration, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
 	}
 
-	return err
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+
+	go func() {
+		defer signal.Stop(c)
+
+		select {
+		case sig := <-c:
+			g.log.Infof("service: %s received %v", g.ID, sig)
+		case <-g.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := g.Shutdown(ctx); err != nil {
+			g.log.Errorf("service: %s shutdown: %v", g.ID, err)
+		}
+	}()
 }
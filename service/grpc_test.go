@@ -0,0 +1,227 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	coordinator "github.com/servicekit/servicekit-go/coordinator/consul"
+	"github.com/servicekit/servicekit-go/health"
+	"github.com/servicekit/servicekit-go/logger"
+)
+
+// testServer serves until ctx is done, then drains for drain, or until Stop
+type testServer struct {
+	drain   time.Duration
+	stopped chan struct{}
+}
+
+func (s *testServer) Serve(ctx context.Context, network, addr, pem, key string) error {
+	<-ctx.Done()
+
+	select {
+	case <-time.After(s.drain):
+	case <-s.stopped:
+	}
+
+	return nil
+}
+
+func (s *testServer) Stop() {
+	close(s.stopped)
+}
+
+func TestGRPCServiceShutdown(t *testing.T) {
+	tests := []struct {
+		drain   time.Duration
+		timeout time.Duration
+		err     error
+	}{
+		{drain: 10 * time.Millisecond, timeout: time.Second, err: nil},
+		{drain: time.Hour, timeout: 50 * time.Millisecond, err: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		server := &testServer{drain: tt.drain, stopped: make(chan struct{})}
+		g := NewGRPCService("account_1", "account", nil, "127.0.0.1", 0, server, "", "", time.Minute,
+			&coordinator.TestConsul{}, &logger.Logger{}, WithPropagationDelay(10*time.Millisecond))
+
+		if err := g.Start(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+		err := g.Shutdown(ctx)
+		cancel()
+
+		if err != tt.err {
+			t.Errorf("Shutdown with drain %v = %v, want %v", tt.drain, err, tt.err)
+		}
+
+		select {
+		case <-g.Done():
+		default:
+			t.Error("Done is not closed after Shutdown")
+		}
+	}
+}
+
+// failingServer is ready at once and fails with err after fail is closed
+type failingServer struct {
+	ready chan struct{}
+	fail  chan struct{}
+	err   error
+}
+
+func (s *failingServer) Serve(ctx context.Context, network, addr, pem, key string) error {
+	close(s.ready)
+
+	select {
+	case <-s.fail:
+		return s.err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (s *failingServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func TestGRPCServiceErrors(t *testing.T) {
+	server := &failingServer{ready: make(chan struct{}), fail: make(chan struct{}), err: errors.New("listener closed")}
+	handled := make(chan error, 1)
+	g := NewGRPCService("account_1", "account", nil, "127.0.0.1", 8080, server, "", "", time.Minute,
+		&coordinator.TestConsul{}, &logger.Logger{}, WithErrorHandler(func(err error) { handled <- err }))
+
+	if err := g.Start(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	close(server.fail)
+
+	select {
+	case err := <-g.Errors():
+		if err != server.err {
+			t.Fatalf("Errors = %v, want %v", err, server.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server error was not reported")
+	}
+	if err := <-handled; err != server.err {
+		t.Fatalf("error handler got %v, want %v", err, server.err)
+	}
+}
+
+func TestGRPCServiceStartFails(t *testing.T) {
+	server := &testServer{stopped: make(chan struct{})}
+	tc := &coordinator.TestConsul{RegisterError: errors.New("consul is down")}
+	g := NewGRPCService("account_1", "account", nil, "127.0.0.1", 0, server, "", "", time.Minute, tc, &logger.Logger{})
+
+	if err := g.Start(context.Background(), 0); err != tc.RegisterError {
+		t.Fatalf("Start = %v, want %v", err, tc.RegisterError)
+	}
+}
+
+// listeningServer listens on addr after delay, or never when delay is zero
+type listeningServer struct {
+	delay time.Duration
+}
+
+func (s *listeningServer) Serve(ctx context.Context, network, addr, pem, key string) error {
+	if s.delay == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	<-ctx.Done()
+
+	return nil
+}
+
+func (s *listeningServer) Stop() {}
+
+func TestGRPCServiceStartWaitsForListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tests := []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		{delay: 100 * time.Millisecond, ok: true},
+		{delay: 0, ok: false},
+	}
+
+	for _, tt := range tests {
+		g := NewGRPCService("account_1", "account", nil, "127.0.0.1", port, &listeningServer{delay: tt.delay}, "", "", time.Minute,
+			&coordinator.TestConsul{}, &logger.Logger{}, WithPropagationDelay(0), WithReadyTimeout(500*time.Millisecond))
+
+		start := time.Now()
+		err := g.Start(context.Background(), 0)
+		if (err == nil) != tt.ok {
+			t.Fatalf("Start with listen delay %v = %v", tt.delay, err)
+		}
+		if tt.ok && time.Since(start) < tt.delay {
+			t.Errorf("Start returned before the server listened")
+		}
+
+		if err == nil {
+			g.Stop()
+		}
+	}
+}
+
+func TestGRPCServiceCheckFollowsHealth(t *testing.T) {
+	h := health.NewHealth("127.0.0.1", 0, "/grpc_service_test", &logger.Logger{})
+	h.GetChan() <- health.ServiceStateOK
+
+	server := &failingServer{ready: make(chan struct{}), fail: make(chan struct{})}
+	tc := &coordinator.TestConsul{}
+	g := NewGRPCService("account_1", "account", nil, "127.0.0.1", 8080, server, "", "", time.Minute,
+		tc, &logger.Logger{}, WithHealth(h), WithPropagationDelay(0))
+
+	if err := g.Start(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	tests := []struct {
+		state  health.ServiceState
+		status string
+	}{
+		{health.ServiceStateOK, "passing"},
+		{health.ServiceStateBusy, "warning"},
+		{health.ServiceStateIdling, "passing"},
+		{health.ServiceStateUnavailable, "critical"},
+	}
+
+	for _, tt := range tests {
+		h.GetChan() <- tt.state
+		for i := 0; i < 100 && h.GetState() != tt.state; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if status := tc.CheckStatus(); status != tt.status {
+			t.Errorf("check status in %s state = %s, want %s", tt.state, status, tt.status)
+		}
+	}
+}
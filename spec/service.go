@@ -5,6 +5,7 @@ type Service struct {
 	ID          string
 	Service     string
 	Tags        []string
+	Meta        map[string]string
 	Version     string
 	Address     string
 	Port        int
@@ -95,6 +95,7 @@ type prom struct {
 
 func (p *prom) init(vecs ...PrometheusVec) {
 	p.Lock()
+	defer p.Unlock()
 
 	if p.inited == true {
 		return
@@ -106,12 +107,45 @@ func (p *prom) init(vecs ...PrometheusVec) {
 	}
 
 	p.inited = true
+}
+
+// register registers the vectors that are not registered yet
+// A vector registered to the default registry already, e.g. by another
+// Trace, is shared.
+func (p *prom) register(vecs ...PrometheusVec) error {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, v := range vecs {
+		if _, ok := p.collectors[v.GetName()]; ok {
+			continue
+		}
+
+		c := v.GetCollector()
+		if err := prometheus.Register(c); err != nil {
+			are, ok := err.(prometheus.AlreadyRegisteredError)
+			if ok == false {
+				return err
+			}
+			c = are.ExistingCollector
+		}
+
+		p.collectors[v.GetName()] = c
+	}
 
-	p.Unlock()
+	return nil
 }
 
-func (p *prom) getCounter(name string) *prometheus.CounterVec {
+func (p *prom) get(name string) (prometheus.Collector, bool) {
+	p.Lock()
+	defer p.Unlock()
+
 	v, ok := p.collectors[name]
+	return v, ok
+}
+
+func (p *prom) getCounter(name string) *prometheus.CounterVec {
+	v, ok := p.get(name)
 	if ok == false {
 		return nil
 	}
@@ -125,7 +159,7 @@ func (p *prom) getCounter(name string) *prometheus.CounterVec {
 }
 
 func (p *prom) getSummary(name string) *prometheus.SummaryVec {
-	v, ok := p.collectors[name]
+	v, ok := p.get(name)
 	if ok == false {
 		return nil
 	}
@@ -139,7 +173,7 @@ func (p *prom) getSummary(name string) *prometheus.SummaryVec {
 }
 
 func (p *prom) getHistogram(name string) *prometheus.HistogramVec {
-	v, ok := p.collectors[name]
+	v, ok := p.get(name)
 	if ok == false {
 		return nil
 	}
@@ -153,7 +187,7 @@ func (p *prom) getHistogram(name string) *prometheus.HistogramVec {
 }
 
 func (p *prom) getGauge(name string) *prometheus.GaugeVec {
-	v, ok := p.collectors[name]
+	v, ok := p.get(name)
 	if ok == false {
 		return nil
 	}
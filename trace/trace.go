@@ -64,11 +64,26 @@ func (h *Trace) Serve() {
 	}
 }
 
+// Handle serves handler at pattern on the trace server, e.g. debug
+// handlers:
+//     t.Handle(consul.DebugPath, consul.DebugHandler())
+func (h *Trace) Handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, handler)
+}
+
 // InitPrometheus init a prometheus handler
 func (h *Trace) InitPrometheus(vecs ...PrometheusVec) {
 	h.prom.init(vecs...)
 }
 
+// Register registers vectors to the Prometheus handler
+// Unlike InitPrometheus, it can be called any number of times, e.g. by
+// interceptors that record their own vectors. A vector whose name is
+// registered already is skipped.
+func (h *Trace) Register(vecs ...PrometheusVec) error {
+	return h.prom.register(vecs...)
+}
+
 // GetCounter returns a prometheus count vector
 func (h *Trace) GetCounter(name string) *prometheus.CounterVec {
 	return h.prom.getCounter(name)
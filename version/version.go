@@ -1,11 +1,62 @@
 package version
 
+import (
+	"regexp"
+	"strings"
+)
+
 const (
 	// Pattern is a regexp for format a version string
 	Pattern = "v\\d+\\.\\d+\\.\\d+"
+
+	// Wildcard matches any value of a version segment, e.g. v1.4.x
+	Wildcard = "x"
 )
 
+var versionRegexp = regexp.MustCompile("^" + Pattern + "$")
+
 // GetVersion return a version
+// It returns the first tag that looks like a version (e.g. v1.4.2), or an
+// empty string when no tag does
 func GetVersion(tags []string) string {
+	for _, tag := range tags {
+		if versionRegexp.MatchString(tag) {
+			return tag
+		}
+	}
+
 	return ""
 }
+
+// Match returns true when version v matches pattern
+// A pattern is a version whose segments may be replaced by Wildcard, e.g.
+// "v1.4.x" matches "v1.4.0" and "v1.4.7". A pattern with fewer segments
+// matches by prefix, so "v1" matches every v1 release.
+// An empty pattern matches every version.
+func Match(pattern, v string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	if v == "" {
+		return false
+	}
+
+	ps := strings.Split(strings.TrimPrefix(pattern, "v"), ".")
+	vs := strings.Split(strings.TrimPrefix(v, "v"), ".")
+
+	if len(ps) > len(vs) {
+		return false
+	}
+
+	for i, p := range ps {
+		if p == Wildcard || p == "*" {
+			continue
+		}
+		if p != vs[i] {
+			return false
+		}
+	}
+
+	return true
+}